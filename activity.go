@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// Number of events the activity page shows by default, and at most
+const (
+	defaultActivityLimit = 50
+	maxActivityLimit     = 1000
+)
+
+// RecentEvents returns the last limit balance changes of envelopes that
+// aren't deleted, newest first. Their Name is the current name of the
+// envelope instead of the one it had back then.
+func (d *DB) RecentEvents(limit int) ([]Event, error) {
+	events := []Event{}
+
+	rows, err := d.db.Query(`
+		SELECT `+eventColumns+`
+		FROM history
+		WHERE NOT meta AND NOT deleted
+			AND envelope IN (SELECT id FROM envelopes WHERE NOT deleted)
+		ORDER BY date DESC, seq DESC
+		LIMIT $1`, limit)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError(err)
+	}
+
+	d.currentNames(events)
+	return events, nil
+}
+
+// currentNames replaces the names in events with the current names of their
+// envelopes.
+func (d *DB) currentNames(events []Event) {
+	names := map[uuid.UUID]string{}
+	for _, e := range append(d.AllEnvelopes(), d.ArchivedEnvelopes()...) {
+		names[e.Id] = e.Name
+	}
+	for i := range events {
+		if name, ok := names[events[i].EnvelopeId]; ok {
+			events[i].Name = name
+		}
+	}
+}
+
+// handleActivity lists the latest balance changes across all envelopes. The
+// n parameter sets how many. With split, only the legs of that split
+// transaction are listed.
+func handleActivity(db *DB, w http.ResponseWriter, r *http.Request) {
+	limit := defaultActivityLimit
+	if r.FormValue("n") != "" {
+		n, err := strconv.Atoi(r.FormValue("n"))
+		if err != nil || n < 1 {
+			renderError(w, r, http.StatusBadRequest, errors.New("n must be a positive number"))
+			return
+		}
+		limit = min(n, maxActivityLimit)
+	}
+
+	var split uuid.UUID
+	if r.FormValue("split") != "" {
+		id, err := uuid.Parse(r.FormValue("split"))
+		if err != nil {
+			renderError(w, r, http.StatusBadRequest, errors.New("invalid split transaction"))
+			return
+		}
+		split = id
+	}
+
+	var events []Event
+	var err error
+	if split == uuid.Nil {
+		events, err = db.RecentEvents(limit)
+	} else {
+		events, err = db.SplitEvents(split)
+	}
+	if err != nil {
+		log.Printf(`activity: can't get recent events: %s`, err)
+		renderError(w, r, http.StatusInternalServerError, errors.New("can't get recent events"))
+		return
+	}
+
+	render(w, r, "activity.html", struct {
+		Events []Event `json:"events"`
+	}{visibleEvents(db, events, requestUser(r))})
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf(`error encoding JSON response: %s`, err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+func handleAPITx(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	var t txRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	envelopes, err := applyTx(db, t, requestUser(r))
+	if err != nil {
+		status := errorStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Printf(`api: can't apply transaction: %s`, err)
+			err = errors.New("can't apply transaction")
+		}
+		writeJSONError(w, status, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Envelopes []*Envelope `json:"envelopes"`
+		Warnings  []string    `json:"warnings,omitempty"`
+	}{envelopes, capWarnings(envelopes)})
+}
+
+// handleAPIHistoryTotals serves the daily total balance between the dates in
+// the from and to parameters, which default to the last 30 days.
+func handleAPIHistoryTotals(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	if r.FormValue("to") != "" {
+		t, err := time.Parse("2006-01-02", r.FormValue("to"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		to = t
+	}
+
+	from := to.AddDate(0, 0, -30)
+	if r.FormValue("from") != "" {
+		t, err := time.Parse("2006-01-02", r.FormValue("from"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		from = t
+	}
+
+	if from.After(to) {
+		writeJSONError(w, http.StatusBadRequest, errors.New("from is after to"))
+		return
+	}
+
+	totals, err := db.BalanceTimeSeries(from, to, requestUser(r))
+	if err != nil {
+		log.Printf(`api: can't compute balance history: %s`, err)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("can't compute balance history"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Currency string       `json:"currency,omitempty"`
+		Totals   []DailyTotal `json:"totals"`
+	}{defaultCurrency, totals})
+}
+
+// handleAPIEnvelopeSeries serves the running balance of an envelope, see
+// BalanceSeries.
+func handleAPIEnvelopeSeries(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	_, err = visibleEnvelope(db, id, requestUser(r))
+	var series []BalancePoint
+	if err == nil {
+		series, err = db.BalanceSeries(id)
+	}
+	if errors.Is(err, errNotFound) {
+		writeJSONError(w, http.StatusNotFound, errors.New("no such envelope"))
+		return
+	} else if err != nil {
+		log.Printf(`api: can't compute balance series of %s: %s`, id, err)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("can't compute balance series"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Series []BalancePoint `json:"series"`
+	}{series})
+}
+
+// envelopeRequest holds the metadata of an envelope for the API. Fields that
+// are left out keep their value.
+type envelopeRequest struct {
+	Name              *string `json:"name,omitempty"`
+	Target            *int    `json:"target_cents,omitempty"`
+	MonthTarget       *int    `json:"monthtarget_cents,omitempty"`
+	Currency          *string `json:"currency,omitempty"`
+	Liability         *bool   `json:"liability,omitempty"`
+	ExcludeFromTotals *bool   `json:"exclude_from_totals,omitempty"`
+	AutoSpread        *string `json:"auto_spread,omitempty"`
+	MonthCap          *int    `json:"month_cap,omitempty"`
+}
+
+func (req envelopeRequest) update(e *Envelope) {
+	if req.Name != nil {
+		e.Name = *req.Name
+	}
+	if req.Target != nil {
+		e.Target = *req.Target
+	}
+	if req.MonthTarget != nil {
+		e.MonthTarget = *req.MonthTarget
+	}
+	if req.Currency != nil {
+		e.Currency = *req.Currency
+	}
+	if req.Liability != nil {
+		e.Liability = *req.Liability
+	}
+	if req.ExcludeFromTotals != nil {
+		e.ExcludeFromTotals = *req.ExcludeFromTotals
+	}
+	if req.AutoSpread != nil {
+		e.AutoSpread = *req.AutoSpread
+	}
+	if req.MonthCap != nil {
+		e.MonthCap = *req.MonthCap
+	}
+}
+
+func decodeEnvelopeRequest(r *http.Request) (envelopeRequest, error) {
+	var req envelopeRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return req, err
+	}
+	return req, req.validate()
+}
+
+// validate checks what metaChange doesn't.
+func (req envelopeRequest) validate() error {
+	if req.Currency != nil {
+		if _, ok := currencies[*req.Currency]; !ok {
+			return fmt.Errorf(`%w: unknown currency %q`, errInvalidValue, *req.Currency)
+		}
+	}
+	return nil
+}
+
+// writeEnvelope responds with the envelope with the given ID. Its ETag is
+// the MetaVersion, which updates can pass in If-Match.
+func writeEnvelope(db *DB, w http.ResponseWriter, status int, id uuid.UUID) {
+	env, err := db.Envelope(id)
+	if err != nil {
+		log.Printf(`api: can't load envelope %s: %s`, id, err)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("can't load envelope"))
+		return
+	}
+
+	w.Header().Set("ETag", `"`+env.MetaVersion()+`"`)
+	writeJSON(w, status, env)
+}
+
+// handleAPIEnvelopes creates an envelope.
+func handleAPIEnvelopes(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	req, err := decodeEnvelopeRequest(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	id, err := db.CreateEnvelope(func(e *Envelope) {
+		e.Owner = requestUser(r)
+		req.update(e)
+	})
+	if errors.Is(err, errInvalidValue) {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		log.Printf(`api: can't create envelope: %s`, err)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("can't create envelope"))
+		return
+	}
+
+	w.Header().Set("Location", routePrefix+"/api/envelopes/"+id.String())
+	writeEnvelope(db, w, http.StatusCreated, id)
+}
+
+// handleAPIEnvelope updates the metadata of an existing envelope. With
+// If-Match, the update is refused if the envelope changed since.
+func handleAPIEnvelope(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		w.Header().Set("Allow", "PUT")
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	req, err := decodeEnvelopeRequest(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if env, err := db.Envelope(id); err == nil && !env.VisibleTo(requestUser(r)) {
+		writeJSONError(w, http.StatusNotFound, errors.New("no such envelope"))
+		return
+	}
+
+	if version := strings.Trim(r.Header.Get("If-Match"), `"`); version != "" {
+		err = db.UpdateEnvelopeMetaVersion(id, version, req.update)
+	} else {
+		err = db.UpdateEnvelopeMeta(id, req.update)
+	}
+	if errors.Is(err, errInvalidValue) {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	} else if errors.Is(err, errNotFound) {
+		writeJSONError(w, http.StatusNotFound, errors.New("no such envelope"))
+		return
+	} else if errors.Is(err, errStaleVersion) {
+		writeJSONError(w, http.StatusPreconditionFailed, err)
+		return
+	} else if err != nil {
+		log.Printf(`api: can't update envelope %s: %s`, id, err)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("can't update envelope"))
+		return
+	}
+
+	writeEnvelope(db, w, http.StatusOK, id)
+}
+
+// handleAPIEvent serves a single event of the history.
+func handleAPIEvent(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	evt, err := visibleEvent(db, id, requestUser(r))
+	if errors.Is(err, errNotFound) {
+		writeJSONError(w, http.StatusNotFound, errors.New("no such event"))
+		return
+	} else if err != nil {
+		log.Printf(`api: can't load event %s: %s`, id, err)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("can't load event"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, evt)
+}
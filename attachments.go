@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// uploadsDir is where receipts uploaded with a transaction are stored. Only
+// the references to them are part of the history, so files uploaded to one
+// instance aren't available on the others.
+var uploadsDir = "uploads"
+
+// Largest receipt that can be uploaded, in bytes
+var maxUploadSize int64 = 10 << 20
+
+const maxAttachmentLength = 500
+
+var (
+	// Extensions of uploads that are kept
+	uploadExt = regexp.MustCompile(`^\.[a-z0-9]{1,8}$`)
+	// Names uploads can have, which is more than saveUpload gives them
+	uploadName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+)
+
+// attachmentRef checks that ref refers to a receipt: either an http or https
+// URL, or the name of a file in uploadsDir. An empty ref is fine.
+func attachmentRef(ref string) (string, error) {
+	ref, err := cleanText("attachment", strings.TrimSpace(ref), maxAttachmentLength)
+	if err != nil || ref == "" {
+		return ref, err
+	}
+	if u, err := url.Parse(ref); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		return ref, nil
+	}
+	if !isUploadName(ref) {
+		return "", fmt.Errorf(`%w: attachment %q is neither a URL nor an uploaded file`, errInvalidValue, ref)
+	}
+	return ref, nil
+}
+
+// isUploadName returns whether name can be the name of a file in uploadsDir.
+func isUploadName(name string) bool {
+	return uploadName.MatchString(name)
+}
+
+// attachmentLink returns where the receipt ref can be looked at.
+func attachmentLink(ref string) string {
+	if isUploadName(ref) {
+		return routePrefix + "/attachments/" + url.PathEscape(ref)
+	}
+	return ref
+}
+
+// saveUpload stores the file uploaded as field of r in uploadsDir, under a new
+// name that keeps its extension. It returns the name, or an empty one if no
+// file was uploaded.
+func saveUpload(r *http.Request, field string) (string, error) {
+	f, header, err := r.FormFile(field)
+	if errors.Is(err, http.ErrMissingFile) || errors.Is(err, http.ErrNotMultipart) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	ext := strings.ToLower(filepath.Ext(header.Filename))
+	if !uploadExt.MatchString(ext) {
+		ext = ""
+	}
+	name := uuid.NewString() + ext
+
+	if err := os.MkdirAll(uploadsDir, 0700); err != nil {
+		return "", err
+	}
+	out, err := os.OpenFile(filepath.Join(uploadsDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, f); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+
+	log.Printf(`stored upload %q as %s`, header.Filename, name)
+	return name, nil
+}
+
+// handleAttachment serves the uploaded receipt given in the path.
+func handleAttachment(db *DB, w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !isUploadName(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Uploads can be anything, so they must not run scripts in the context
+	// of the site
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, filepath.Join(uploadsDir, name))
+}
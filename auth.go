@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// requireAuth wraps next with HTTP basic auth. An empty password disables
+// authentication entirely, which is the default for a localhost-only setup.
+func requireAuth(password string, next http.HandlerFunc) http.HandlerFunc {
+	if password == "" {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, pass, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="envelopes", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Backup writes a snapshot of the DB to a new, timestamped file in dir and
+// returns its path. With encryption enabled, the snapshot is encrypted like
+// the DB itself.
+func (d *DB) Backup(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	name := "envelopes-" + time.Now().UTC().Format("20060102-150405") + ".sqlite"
+	if d.cipher != nil {
+		path := filepath.Join(dir, name+".enc")
+		data, err := d.sealed()
+		if err != nil {
+			return "", err
+		}
+		return path, writeFileSync(path, data)
+	}
+
+	path := filepath.Join(dir, name)
+	// VACUUM INTO refuses to overwrite an existing file, so two backups in
+	// the same second don't clobber each other.
+	if _, err := d.db.Exec(`VACUUM INTO $1`, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// backupEvery takes a backup to dir every interval until the process exits.
+func backupEvery(db *DB, dir string, interval time.Duration) {
+	for range time.Tick(interval) {
+		path, err := db.Backup(dir)
+		if err != nil {
+			log.Printf(`scheduled backup failed: %s`, err)
+			continue
+		}
+		log.Printf(`wrote backup to %s`, path)
+	}
+}
+
+func handleBackup(db *DB, dir string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	path, err := db.Backup(dir)
+	if err != nil {
+		log.Printf(`backup failed: %s`, err)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("backup failed"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Path string `json:"path"`
+	}{path})
+}
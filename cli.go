@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/google/uuid"
+)
+
+// commands are the subcommands that can be run instead of serving HTTP. They
+// use the same DB methods as the web handlers.
+var commands = map[string]func(db *DB, out io.Writer, args []string) error{
+	"list":            cmdList,
+	"tx":              cmdTx,
+	"export":          cmdExport,
+	"export-identity": cmdExportIdentity,
+	"import-identity": cmdImportIdentity,
+}
+
+// runCommand runs the subcommand named by args[0] with the rest of args.
+func runCommand(db *DB, out io.Writer, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf(`unknown command %q, want one of list, tx, export, export-identity or import-identity`, args[0])
+	}
+	return cmd(db, out, args[1:])
+}
+
+// cmdList prints the envelopes with their balances, one per line.
+func cmdList(db *DB, out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	archived := fs.Bool("archived", false, "list archived envelopes instead")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	envelopes := db.AllEnvelopes()
+	if *archived {
+		envelopes = db.ArchivedEnvelopes()
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, e := range envelopes {
+		cur := lookupCurrency(e.Currency)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.Id, e.Name, cur.Format(e.Balance), cur.Format(e.Target))
+	}
+	return tw.Flush()
+}
+
+// cmdTx records a transaction, like the transaction form does.
+func cmdTx(db *DB, out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("tx", flag.ContinueOnError)
+	envelope := fs.String("envelope", "", "ID of the envelope")
+	amount := fs.String("amount", "", "amount, in the currency of the envelope")
+	direction := fs.String("direction", "out", "in, out or inout")
+	to := fs.String("to", "", "ID of the destination envelope for inout")
+	comment := fs.String("comment", "", "comment")
+	tags := fs.String("tags", "", "comma separated tags")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	id, err := uuid.Parse(*envelope)
+	if err != nil {
+		return fmt.Errorf(`invalid envelope ID %q: %w`, *envelope, err)
+	}
+	env, err := db.Envelope(id)
+	if err != nil {
+		return fmt.Errorf(`can't load envelope %s: %w`, id, err)
+	}
+	if *amount == "" {
+		return errors.New("missing amount")
+	}
+	cents, err := lookupCurrency(env.Currency).Parse(*amount)
+	if err != nil {
+		return err
+	}
+
+	t := txRequest{
+		EnvelopeId: id,
+		Amount:     cents,
+		Direction:  *direction,
+		Comment:    *comment,
+		Tags:       parseTags(*tags),
+	}
+	if *to != "" {
+		dest, err := uuid.Parse(*to)
+		if err != nil {
+			return fmt.Errorf(`invalid destination ID %q: %w`, *to, err)
+		}
+		t.DestinationId = &dest
+	}
+
+	envelopes, err := applyTx(db, t, "")
+	if err != nil {
+		return err
+	}
+	for _, e := range envelopes {
+		fmt.Fprintf(out, "%s: %s\n", e.Name, lookupCurrency(e.Currency).Format(e.Balance))
+	}
+	return nil
+}
+
+// cmdExport writes the whole history as JSON, in the format /admin/export
+// serves and /admin/restore takes.
+func cmdExport(db *DB, out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	events, err := db.ExportEvents()
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(out).Encode(events)
+}
+
+// identity is what identifies this instance to others. For now, that is only
+// the name it records as the origin of its events.
+type identity struct {
+	Nick string `json:"nick"`
+}
+
+// cmdExportIdentity writes the identity of this instance as JSON, for
+// import-identity on a new machine.
+func cmdExportIdentity(db *DB, out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("export-identity", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return json.NewEncoder(out).Encode(identity{Nick: db.origin})
+}
+
+// cmdImportIdentity replaces the identity of this instance with the one in
+// the file given as argument, or on stdin if there is none.
+func cmdImportIdentity(db *DB, out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("import-identity", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.NArg() > 0 && fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var id identity
+	dec := json.NewDecoder(in)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&id); err != nil {
+		return fmt.Errorf(`can't parse identity: %w`, err)
+	}
+
+	if err := db.SetInstanceName(id.Nick); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "this instance is now known as %s\n", id.Nick)
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// recordConflictWithTx notes that the metadata event e is about to lose
+// against the newer metadata env already has. Changes that arrive late from
+// the instance that also made the newer one were simply superseded and aren't
+// conflicts, and neither are ones that wouldn't change anything.
+func (d *DB) recordConflictWithTx(tx *sql.Tx, env *Envelope, e Event) error {
+	if !e.Meta || env.metaEvent == uuid.Nil || metaNewer(e.Date, e.Id, env.metaDate, env.metaEvent) {
+		return nil
+	}
+
+	lost := *env
+	lost.setMeta(e)
+	if lost.sameMeta(env) {
+		return nil
+	}
+
+	var origin string
+	err := tx.QueryRow(`SELECT origin FROM history WHERE id = $1`, env.metaEvent).Scan(&origin)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if origin == e.Origin {
+		return nil
+	}
+
+	log.Printf(`metadata change %s of %s lost against %s`, e.Id, env.Id, env.metaEvent)
+	_, err = tx.Exec(`INSERT OR IGNORE INTO conflicts(event, envelope, winner) VALUES ($1, $2, $3)`,
+		e.Id, env.Id, env.metaEvent)
+	return err
+}
+
+// ConflictField is a metadata field whose value was lost in a conflict.
+type ConflictField struct {
+	Field   string `json:"field"`
+	Current string `json:"current"`
+	Lost    string `json:"lost"`
+}
+
+// Conflict is a metadata change that lost against a newer one.
+type Conflict struct {
+	Envelope *Envelope       `json:"envelope"`
+	Event    *Event          `json:"event"`
+	Fields   []ConflictField `json:"fields"`
+}
+
+// metaDiff returns the metadata fields in which lost differs from cur.
+func metaDiff(cur, lost *Envelope) []ConflictField {
+	fields := []ConflictField{}
+	for _, f := range []ConflictField{
+		{"name", cur.Name, lost.Name},
+		{"target", money(cur.Target, cur.Currency), money(lost.Target, lost.Currency)},
+		{"monthly target", money(cur.MonthTarget, cur.Currency), money(lost.MonthTarget, lost.Currency)},
+		{"currency", cur.Currency, lost.Currency},
+		{"archived", strconv.FormatBool(cur.Archived), strconv.FormatBool(lost.Archived)},
+		{"goal", money(cur.GoalAmount, cur.Currency), money(lost.GoalAmount, lost.Currency)},
+		{"goal date", cur.GoalDate, lost.GoalDate},
+		{"liability", strconv.FormatBool(cur.Liability), strconv.FormatBool(lost.Liability)},
+		{"excluded from totals", strconv.FormatBool(cur.ExcludeFromTotals), strconv.FormatBool(lost.ExcludeFromTotals)},
+		{"owner", cur.Owner, lost.Owner},
+		{"spread income", cur.AutoSpread, lost.AutoSpread},
+		{"monthly cap", money(cur.MonthCap, cur.Currency), money(lost.MonthCap, lost.Currency)},
+	} {
+		if f.Current != f.Lost {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// Conflicts returns the conflicts that haven't been resolved yet, oldest
+// first. Conflicts of deleted envelopes are left out.
+func (d *DB) Conflicts() ([]Conflict, error) {
+	rows, err := d.db.Query(`SELECT event FROM conflicts WHERE NOT resolved ORDER BY rowid`)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, dbError(err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, dbError(err)
+	}
+
+	conflicts := []Conflict{}
+	for _, id := range ids {
+		c, err := d.conflict(id)
+		if errors.Is(err, errNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, *c)
+	}
+	return conflicts, nil
+}
+
+func (d *DB) conflict(eventId uuid.UUID) (*Conflict, error) {
+	evt, err := d.Event(eventId)
+	if err != nil {
+		return nil, err
+	}
+	env, err := d.Envelope(evt.EnvelopeId)
+	if err != nil {
+		return nil, err
+	}
+
+	lost := *env
+	lost.setMeta(*evt)
+	return &Conflict{env, evt, metaDiff(env, &lost)}, nil
+}
+
+// ResolveConflict marks the conflict of the metadata event with the given ID
+// as resolved. If restore is set, the metadata of that event is applied again
+// as a new change first.
+func (d *DB) ResolveConflict(eventId uuid.UUID, restore bool) error {
+	var envelope uuid.UUID
+	err := d.db.QueryRow(`SELECT envelope FROM conflicts WHERE event = $1 AND NOT resolved`, eventId).Scan(&envelope)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf(`%w: conflict %s`, errNotFound, eventId)
+	} else if err != nil {
+		return dbError(err)
+	}
+
+	if restore {
+		evt, err := d.Event(eventId)
+		if err != nil {
+			return err
+		}
+		err = d.UpdateEnvelopeMeta(envelope, func(e *Envelope) {
+			e.setMeta(*evt)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := d.db.Exec(`UPDATE conflicts SET resolved = 1 WHERE event = $1`, eventId); err != nil {
+		return dbError(err)
+	}
+	return dbError(d.persist())
+}
+
+// handleConflicts lists the unresolved conflicts. Posting the event of one
+// with action "restore" applies its metadata again, "dismiss" keeps the
+// current one.
+func handleConflicts(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		conflicts, err := db.Conflicts()
+		if err != nil {
+			log.Printf(`conflicts: can't list conflicts: %s`, err)
+			renderError(w, r, http.StatusInternalServerError, errors.New("can't list conflicts"))
+			return
+		}
+		render(w, r, "conflicts.html", struct {
+			Conflicts []Conflict `json:"conflicts"`
+		}{conflicts})
+		return
+	}
+
+	id, err := uuid.Parse(r.FormValue("event"))
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "restore":
+		err = db.ResolveConflict(id, true)
+	case "dismiss":
+		err = db.ResolveConflict(id, false)
+	default:
+		renderError(w, r, http.StatusBadRequest, errors.New("unknown action"))
+		return
+	}
+	if err != nil {
+		status := errorStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Printf(`conflicts: can't resolve %s: %s`, id, err)
+			err = errors.New("can't resolve conflict")
+		}
+		renderError(w, r, status, err)
+		return
+	}
+
+	redirect(w, r, "/admin/conflicts")
+}
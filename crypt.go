@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// With ENVELOPES_DB_KEY set, the DB only lives in memory. After every change,
+// it is written to the DB path with ".enc" appended, encrypted with AES-GCM
+// using a key derived from the passphrase. Each write encrypts and replaces
+// the whole file, so this is only meant for small DBs.
+//
+// The in-memory DB lives as long as the single connection of the pool. If
+// database/sql ever replaces that connection, the new one starts out empty,
+// so sealed refuses to write a DB without a schema.
+
+// errLostDB is returned by persist if the in-memory DB is gone.
+var errLostDB = errors.New("in-memory DB was lost, not overwriting the encrypted one")
+
+var encryptedMagic = []byte("envelopes-aes-gcm-1\n")
+
+type dbCipher struct {
+	aead cipher.AEAD
+	salt []byte
+}
+
+func newDBCipher(passphrase string, salt []byte) (*dbCipher, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, 600000, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &dbCipher{aead, salt}, nil
+}
+
+// seal encrypts plain. The result starts with the magic, the salt and the
+// nonce, so open only needs the passphrase.
+func (c *dbCipher) seal(plain []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	rv := append([]byte{}, encryptedMagic...)
+	rv = append(rv, c.salt...)
+	rv = append(rv, nonce...)
+	return c.aead.Seal(rv, nonce, plain, encryptedMagic), nil
+}
+
+func openEncrypted(passphrase string, data []byte) (*dbCipher, []byte, error) {
+	if !bytes.HasPrefix(data, encryptedMagic) {
+		return nil, nil, errors.New(`not an encrypted envelopes DB`)
+	}
+	data = data[len(encryptedMagic):]
+	if len(data) < 16 {
+		return nil, nil, errors.New(`encrypted DB is truncated`)
+	}
+
+	c, err := newDBCipher(passphrase, data[:16])
+	if err != nil {
+		return nil, nil, err
+	}
+	data = data[16:]
+	if len(data) < c.aead.NonceSize() {
+		return nil, nil, errors.New(`encrypted DB is truncated`)
+	}
+
+	plain, err := c.aead.Open(nil, data[:c.aead.NonceSize()], data[c.aead.NonceSize():], encryptedMagic)
+	if err != nil {
+		return nil, nil, errors.New(`can't decrypt DB, wrong ENVELOPES_DB_KEY?`)
+	}
+	return c, plain, nil
+}
+
+func (d *DB) rawConn(f func(c *sqlite3.SQLiteConn) error) error {
+	conn, err := d.db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(dc interface{}) error {
+		return f(dc.(*sqlite3.SQLiteConn))
+	})
+}
+
+// loadEncrypted loads the encrypted DB into memory. If there is none yet, but
+// a plain text one, that one is loaded instead, and migrate returns its path
+// so it can be moved out of the way once the encrypted copy is written.
+func (d *DB) loadEncrypted(passphrase, plainPath string) (migrate string, err error) {
+	var plain []byte
+
+	data, err := os.ReadFile(d.encryptedPath)
+	switch {
+	case err == nil:
+		d.cipher, plain, err = openEncrypted(passphrase, data)
+		if err != nil {
+			return "", fmt.Errorf(`%s: %w`, d.encryptedPath, err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		if d.cipher, err = newDBCipher(passphrase, salt); err != nil {
+			return "", err
+		}
+
+		if _, err := os.Stat(plainPath); err != nil {
+			// Neither an encrypted nor a plain text DB, start from scratch
+			return "", nil
+		}
+		log.Printf(`encrypting existing DB %s`, plainPath)
+		if plain, err = readPlainDB(plainPath); err != nil {
+			return "", err
+		}
+		migrate = plainPath
+	default:
+		return "", err
+	}
+
+	return migrate, d.rawConn(func(c *sqlite3.SQLiteConn) error {
+		return c.Deserialize(plain, "main")
+	})
+}
+
+// readPlainDB returns the contents of the plain text DB at path, including
+// changes that are still in its write-ahead log.
+func readPlainDB(path string) ([]byte, error) {
+	db, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		return nil, err
+	}
+	// Leaving WAL mode checkpoints the log. An in-memory DB can't use WAL,
+	// so the copy has to be in rollback journal mode anyway.
+	if _, err := db.Exec(`PRAGMA journal_mode=DELETE`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// persist writes the encrypted DB if encryption is enabled. It is called
+// after every committed change, and must not be called while a transaction
+// is open.
+func (d *DB) persist() error {
+	gen := d.generation.Add(1)
+
+	if d.cipher == nil {
+		return nil
+	}
+
+	// Writes share the temporary file, and an older snapshot must never
+	// replace a newer one
+	d.persistMu.Lock()
+	defer d.persistMu.Unlock()
+
+	if d.persisted >= gen {
+		// Written along with a later change already
+		return nil
+	}
+	// The snapshot is taken after all changes up to cur were committed
+	cur := d.generation.Load()
+	data, err := d.sealed()
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(d.encryptedPath, data); err != nil {
+		return err
+	}
+	d.persisted = cur
+	return nil
+}
+
+// sealed returns the encrypted contents of the DB, or errLostDB if it doesn't
+// have a history table anymore.
+func (d *DB) sealed() ([]byte, error) {
+	conn, err := d.db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var tables int
+	err = conn.QueryRowContext(context.Background(),
+		`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'history'`).Scan(&tables)
+	if err != nil {
+		return nil, err
+	}
+	if tables == 0 {
+		return nil, errLostDB
+	}
+
+	var plain []byte
+	err = conn.Raw(func(dc interface{}) error {
+		var err error
+		plain, err = dc.(*sqlite3.SQLiteConn).Serialize("main")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return d.cipher.seal(plain)
+}
+
+// writeFileSync replaces path with data, so that either the old or the new
+// contents are there even if the machine crashes halfway through.
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
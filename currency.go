@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type Currency struct {
+	Code   string
+	Symbol string
+	// Number of digits of the minor unit, 2 for cents
+	Digits int
+}
+
+var currencies = map[string]Currency{
+	"CHF": {"CHF", "CHF", 2},
+	"CZK": {"CZK", "Kč", 2},
+	"DKK": {"DKK", "kr.", 2},
+	"EUR": {"EUR", "€", 2},
+	"GBP": {"GBP", "£", 2},
+	"JPY": {"JPY", "¥", 0},
+	"NOK": {"NOK", "kr", 2},
+	"PLN": {"PLN", "zł", 2},
+	"SEK": {"SEK", "kr", 2},
+	"USD": {"USD", "$", 2},
+}
+
+var defaultCurrency = "EUR"
+
+func lookupCurrency(code string) Currency {
+	if c, ok := currencies[code]; ok {
+		return c
+	}
+	return currencies[defaultCurrency]
+}
+
+func sortedCurrencies() []Currency {
+	rv := []Currency{}
+	for _, c := range currencies {
+		rv = append(rv, c)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Code < rv[j].Code
+	})
+	return rv
+}
+
+func (c Currency) scale() int {
+	s := 1
+	for i := 0; i < c.Digits; i++ {
+		s *= 10
+	}
+	return s
+}
+
+// Parse parses a decimal amount as typed by a user into minor units. Both
+// "1.234,56" and "1,234.56" work: if there is a comma and a dot, the last one
+// is the decimal separator. A lone separator followed by exactly three digits,
+// like in "1.005", could be either, so it is refused, unless the currency has
+// no minor unit or three digits in it, or the amount starts with a zero.
+// Currency symbols and codes,
+// spaces and apostrophes are ignored. Amounts with more decimal places than
+// the currency has are refused. Errors wrap errInvalidValue.
+func (c Currency) Parse(s string) (int, error) {
+	orig := s
+	// Longest first, so "kr." isn't mistaken for "kr" followed by a dot
+	symbols := []string{}
+	for _, cur := range currencies {
+		symbols = append(symbols, cur.Code, cur.Symbol)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		return len(symbols[i]) > len(symbols[j])
+	})
+	for _, sym := range symbols {
+		s = strings.ReplaceAll(s, sym, "")
+	}
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || r == '\'' || r == '’' {
+			return -1
+		}
+		return r
+	}, s)
+
+	negative := false
+	if strings.HasPrefix(s, "-") {
+		negative = true
+		s = s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+
+	if !strings.ContainsAny(s, "0123456789") || strings.Trim(s, "0123456789.,") != "" {
+		return 0, fmt.Errorf(`%w: can't parse amount %q`, errInvalidValue, orig)
+	}
+
+	whole, frac := s, ""
+	if i := strings.LastIndexAny(s, ".,"); i >= 0 {
+		sep := s[i]
+		other := byte(',')
+		if sep == ',' {
+			other = '.'
+		}
+		mixed := strings.IndexByte(s, other) >= 0
+		lone := strings.Count(s, string(sep)) == 1
+		// Thousands don't start with a zero, so "0.001" has too many
+		// decimal places instead
+		thousands := len(s)-i-1 == 3 && c.Digits != 3 && i > 0 && s[0] != '0'
+		if lone && !mixed && thousands && c.Digits != 0 {
+			return 0, fmt.Errorf(`%w: amount %q is ambiguous, use both separators or none`, errInvalidValue, orig)
+		}
+		if mixed || (lone && !thousands) {
+			if strings.IndexByte(s[i+1:], other) >= 0 || !lone {
+				return 0, fmt.Errorf(`%w: can't parse amount %q`, errInvalidValue, orig)
+			}
+			whole, frac = s[:i], s[i+1:]
+		}
+	}
+	whole = strings.NewReplacer(".", "", ",", "").Replace(whole)
+
+	if len(frac) > c.Digits {
+		return 0, fmt.Errorf(`%w: amount %q has more than %d decimal places`, errInvalidValue, orig, c.Digits)
+	}
+	frac += strings.Repeat("0", c.Digits-len(frac))
+
+	amount, err := strconv.Atoi(whole + frac)
+	if err != nil {
+		return 0, fmt.Errorf(`%w: can't parse amount %q`, errInvalidValue, orig)
+	}
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+// Decimal renders amount, given in minor units, as a plain decimal number
+// suitable for form inputs.
+func (c Currency) Decimal(amount int) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	if c.Digits == 0 {
+		return fmt.Sprintf("%s%d", sign, amount)
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/c.scale(), c.Digits, amount%c.scale())
+}
+
+func (c Currency) Format(amount int) string {
+	return strings.TrimSpace(c.Symbol + " " + c.Decimal(amount))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		// Amounts that can't be represented exactly as floats
+		{"0.1", 10},
+		{"0.2", 20},
+		{"0.3", 30},
+		{"0.30", 30},
+		{"19.99", 1999},
+		// Several separators are thousands
+		{"1.005.000", 100500000},
+		{"4.35", 435},
+		{"1.15", 115},
+		{"0.07", 7},
+		{"-0.29", -29},
+		{"1.234,56", 123456},
+		{"1,234.56", 123456},
+		{"€ 12", 1200},
+		{"€5", 500},
+		{"5€", 500},
+		{"12.50 \n", 1250},
+		{" 7 ", 700},
+		{"1'000.10", 100010},
+	}
+
+	eur := currencies["EUR"]
+	for _, tt := range tests {
+		got, err := eur.Parse(tt.in)
+		if err != nil {
+			t.Errorf(`Parse(%q): %s`, tt.in, err)
+		} else if got != tt.want {
+			t.Errorf(`Parse(%q) = %d, want %d`, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	eur := currencies["EUR"]
+	for _, in := range []string{"0.001", ".999", "1.9999", "1,999.005", "0.1+0.2", "1e2", "", "€", "1.2.3,4,5",
+		// A lone separator followed by three digits could be either
+		"1.005", "1,999", "€1.000"} {
+		if got, err := eur.Parse(in); !errors.Is(err, errInvalidValue) {
+			t.Errorf(`Parse(%q) = %d, %v, want errInvalidValue`, in, got, err)
+		}
+	}
+
+	if got, err := currencies["JPY"].Parse("100.5"); !errors.Is(err, errInvalidValue) {
+		t.Errorf(`Parse("100.5") in JPY = %d, %v, want errInvalidValue`, got, err)
+	}
+	// Without a minor unit, there is nothing to confuse thousands with
+	if got, err := currencies["JPY"].Parse("1.005"); err != nil || got != 1005 {
+		t.Errorf(`Parse("1.005") in JPY = %d, %v, want 1005`, got, err)
+	}
+}
@@ -2,53 +2,404 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// dateFormat is used for all dates stored in the DB and carried in events.
+// It is RFC 3339 in UTC with a fixed number of fractional digits, so dates
+// sort correctly as strings.
+const dateFormat = "2006-01-02T15:04:05.000Z07:00"
+
+func eventDate() string {
+	return time.Now().UTC().Format(dateFormat)
+}
+
+// normalizeDate returns date in dateFormat. Besides RFC 3339, it accepts the
+// format SQLite's datetime() produces, which older history entries use, and
+// the one of time.Time.String, which older events carried. It returns an
+// empty string if date can't be parsed.
+func normalizeDate(date string) string {
+	// Drop the monotonic clock reading time.Time.String appends
+	if i := strings.Index(date, " m="); i >= 0 {
+		date = date[:i]
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02 15:04:05.999999999 -0700 MST"} {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t.UTC().Format(dateFormat)
+		}
+	}
+	return ""
+}
+
+// metaDate returns the date for a local metadata change to an envelope whose
+// metadata was last changed at cur. It is always later than cur, so the new
+// change wins even if it happens within the same millisecond.
+func metaDate(cur string) string {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if t, err := time.Parse(time.RFC3339Nano, cur); err == nil && !now.After(t) {
+		now = t.Add(time.Millisecond)
+	}
+	return now.Format(dateFormat)
+}
+
+// Event is a single change to an envelope. Balance is always a delta, and
+// balance changes from different sources simply add up.
+//
+// If Meta is set, the event also changes the envelope's metadata: Name is the
+// new name, and Target and MonthTarget are deltas relative to PrevTarget and
+// PrevMonthTarget, so the new target is PrevTarget + Target. Currency,
+// Archived and the goal are the new values as well. Metadata is
+// last-writer-wins: a change only takes effect if its Date is later than the
+// one of the change that last set the envelope's metadata, with ties broken
+// by the larger Id. Losing changes are still recorded in the history.
+// Events without Meta leave name and targets alone, except for events written
+// before metadata was tracked, whose Target and MonthTarget are plain deltas.
 type Event struct {
-	EnvelopeId  uuid.UUID
-	Id          uuid.UUID
-	Date        string
-	Name        string
-	Balance     int
-	Target      int
-	MonthTarget int
-	Deleted     bool
-	Comment     string
+	EnvelopeId      uuid.UUID
+	Id              uuid.UUID
+	Date            string
+	Name            string
+	Balance         int
+	Target          int
+	MonthTarget     int
+	Deleted         bool
+	Comment         string
+	Meta            bool
+	PrevTarget      int
+	PrevMonthTarget int
+	Currency        string
+	// ID of the event this event compensates, if any
+	Reverses uuid.UUID
+	// Instance that created the event
+	Origin   string
+	Archived bool
+	Tags     []string
+	// Savings goal, see Envelope
+	GoalAmount int
+	GoalDate   string
+	// How the envelope counts in totals, see Envelope
+	Liability         bool
+	ExcludeFromTotals bool
+	Owner             string
+	AutoSpread        string
+	MonthCap          int
+	// Where the money of a balance change came from or went to, one of the
+	// Kind constants
+	Kind string
+	// Receipt of a balance change, see attachmentRef
+	Attachment string
+	// Shared by the parts of a transaction split across envelopes
+	SplitGroup uuid.UUID
+}
+
+// Kinds of balance changes
+const (
+	// Money coming in from or going out to the world outside the envelopes
+	KindExternal = "external"
+	// Money moved between two envelopes by Transfer
+	KindTransfer = "transfer"
+	// Money moved between envelopes by Spread
+	KindSpread = "spread"
+	// What the history of an envelope added up to before PruneHistory
+	// removed it
+	KindOpening = "opening"
+)
+
+// isSpending is true for history entries h that are money going out to
+// external accounts. Outflows that were reversed and the reversals don't count.
+const isSpending = `(h.kind = 'external' AND h.balance < 0
+	AND h.id NOT IN (SELECT reverses FROM history) AND h.reverses NOT IN (SELECT id FROM history))`
+
+// eventColumns are the columns of the history table that scanEvent expects.
+const eventColumns = `id, envelope, date, name, balance, target, monthtarget, comment, deleted,
+	meta, prevtarget, prevmonthtarget, currency, reverses, origin, archived, tags, goalamount, goaldate, kind, liability,
+	excludetotals, owner, autospread, monthcap, attachment, splitgroup`
+
+// rowScanner is either *sql.Rows or *sql.Row.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEvent(rows rowScanner) (Event, error) {
+	var (
+		e    Event
+		tags string
+	)
+	err := rows.Scan(&e.Id, &e.EnvelopeId, &e.Date, &e.Name, &e.Balance, &e.Target, &e.MonthTarget, &e.Comment, &e.Deleted,
+		&e.Meta, &e.PrevTarget, &e.PrevMonthTarget, &e.Currency, &e.Reverses, &e.Origin, &e.Archived, &tags,
+		&e.GoalAmount, &e.GoalDate, &e.Kind, &e.Liability, &e.ExcludeFromTotals, &e.Owner, &e.AutoSpread, &e.MonthCap, &e.Attachment, &e.SplitGroup)
+	e.Tags = parseTags(tags)
+	return e, err
 }
 
 type Envelope struct {
-	// Values in Euro-cents
-	Id          uuid.UUID
-	Balance     int
-	Target      int
-	Name        string
-	MonthDelta  int
-	MonthTarget int
+	// Values in minor units of Currency
+	Id          uuid.UUID `json:"id"`
+	Balance     int       `json:"balance"`
+	Target      int       `json:"target"`
+	Name        string    `json:"name"`
+	MonthDelta  int       `json:"month_delta"`
+	MonthTarget int       `json:"month_target"`
+	Currency    string    `json:"currency"`
+	// Archived envelopes are kept, but hidden from the overview
+	Archived bool `json:"archived"`
+	// Optional savings goal: GoalAmount should be in the envelope by
+	// GoalDate (YYYY-MM-DD)
+	GoalAmount int    `json:"goal_amount,omitempty"`
+	GoalDate   string `json:"goal_date,omitempty"`
+	// Liabilities track money owed, so a balance above the target is bad
+	Liability bool `json:"liability"`
+	// Shown, but not counted in the totals of the overview
+	ExcludeFromTotals bool `json:"exclude_from_totals"`
+	// User the envelope belongs to, shared by everyone if empty
+	Owner string `json:"owner,omitempty"`
+	// Spread mode to spread income with right away, or empty
+	AutoSpread string `json:"auto_spread,omitempty"`
+	// Most that should be spent from the envelope each month, if set
+	MonthCap int `json:"month_cap,omitempty"`
+	// Money spent from the envelope this month, only set for the overview
+	MonthSpent int `json:"month_spent"`
+
+	// Date and ID of the event that last changed the metadata
+	metaDate  string
+	metaEvent uuid.UUID
+}
+
+// GoalMonthly is how much has to go into the envelope each month, starting
+// with the one of now, to reach its goal by the goal date. It is zero if there
+// is no goal or it has been reached. Once the goal date has passed, all of
+// the rest is due now.
+func (e *Envelope) GoalMonthly(now time.Time) int {
+	if e.GoalAmount <= 0 || e.GoalDate == "" {
+		return 0
+	}
+	due, err := time.Parse("2006-01-02", e.GoalDate)
+	if err != nil {
+		return 0
+	}
+
+	remaining := e.GoalAmount - e.Balance
+	if remaining <= 0 {
+		return 0
+	}
+
+	months := (due.Year()-now.Year())*12 + int(due.Month()-now.Month()) + 1
+	if months < 1 {
+		months = 1
+	}
+	// Round up so the goal is reached in time
+	return (remaining + months - 1) / months
+}
+
+// MetaVersion identifies the current metadata of the envelope. It changes
+// whenever the metadata does.
+func (e *Envelope) MetaVersion() string {
+	return e.metaEvent.String()
+}
+
+// MonthRemaining is how much still has to go into the envelope this month to
+// reach its monthly target.
+func (e *Envelope) MonthRemaining() int {
+	if e.MonthTarget <= 0 || e.MonthDelta >= e.MonthTarget {
+		return 0
+	}
+	if e.MonthDelta < 0 {
+		return e.MonthTarget
+	}
+	return e.MonthTarget - e.MonthDelta
+}
+
+// OverCap reports whether more was spent from the envelope this month than
+// its monthly cap allows.
+func (e *Envelope) OverCap() bool {
+	return e.MonthCap > 0 && e.MonthSpent > e.MonthCap
+}
+
+func (e *Envelope) apply(evt Event) {
+	e.Balance += evt.Balance
+
+	if !evt.Meta {
+		e.Target += evt.Target
+		e.MonthTarget += evt.MonthTarget
+		return
+	}
+
+	if !metaNewer(evt.Date, evt.Id, e.metaDate, e.metaEvent) {
+		log.Printf(`event %s is older than metadata of %s, not applying it`, evt.Id, e.Id)
+		return
+	}
+
+	e.setMeta(evt)
+	e.metaDate = evt.Date
+	e.metaEvent = evt.Id
+}
+
+// setMeta sets the metadata of e to the one of the metadata event evt.
+func (e *Envelope) setMeta(evt Event) {
+	e.Name = evt.Name
+	if evt.Currency != "" {
+		e.Currency = evt.Currency
+	}
+	e.Archived = evt.Archived
+	e.GoalAmount = evt.GoalAmount
+	e.GoalDate = evt.GoalDate
+	e.Liability = evt.Liability
+	e.ExcludeFromTotals = evt.ExcludeFromTotals
+	e.Owner = evt.Owner
+	e.AutoSpread = evt.AutoSpread
+	e.MonthCap = evt.MonthCap
+	e.Target = evt.PrevTarget + evt.Target
+	e.MonthTarget = evt.PrevMonthTarget + evt.MonthTarget
+}
+
+func metaNewer(date string, id uuid.UUID, curDate string, curId uuid.UUID) bool {
+	t, _ := time.Parse(time.RFC3339Nano, date)
+	cur, _ := time.Parse(time.RFC3339Nano, curDate)
+	if !t.Equal(cur) {
+		return t.After(cur)
+	}
+	return id.String() > curId.String()
+}
+
+func (e *Envelope) sameMeta(o *Envelope) bool {
+	return e.Name == o.Name && e.Target == o.Target && e.MonthTarget == o.MonthTarget &&
+		e.Currency == o.Currency && e.Archived == o.Archived &&
+		e.GoalAmount == o.GoalAmount && e.GoalDate == o.GoalDate && e.Liability == o.Liability &&
+		e.ExcludeFromTotals == o.ExcludeFromTotals && e.Owner == o.Owner &&
+		e.AutoSpread == o.AutoSpread && e.MonthCap == o.MonthCap
 }
 
+// metaEvent returns an event that changes the metadata of old to the one of
+// changed.
+func (d *DB) metaEvent(old, changed *Envelope) Event {
+	return Event{
+		EnvelopeId:        old.Id,
+		Id:                uuid.New(),
+		Date:              metaDate(old.metaDate),
+		Origin:            d.origin,
+		Name:              changed.Name,
+		Target:            changed.Target - old.Target,
+		MonthTarget:       changed.MonthTarget - old.MonthTarget,
+		Meta:              true,
+		PrevTarget:        old.Target,
+		PrevMonthTarget:   old.MonthTarget,
+		Currency:          changed.Currency,
+		Archived:          changed.Archived,
+		GoalAmount:        changed.GoalAmount,
+		GoalDate:          changed.GoalDate,
+		Liability:         changed.Liability,
+		ExcludeFromTotals: changed.ExcludeFromTotals,
+		Owner:             changed.Owner,
+		AutoSpread:        changed.AutoSpread,
+		MonthCap:          changed.MonthCap,
+	}
+}
+
+// DB is the event store. Writes outside of MergeEvent and mergeAll have to
+// call persist once they are committed.
 type DB struct {
 	db     *sql.DB
-	Events chan Event
+	stmts  statements
+	origin string
+	// Set if the DB is encrypted at rest
+	cipher        *dbCipher
+	encryptedPath string
+	Events        chan Event
+	// Number of changes committed since the DB was opened
+	generation atomic.Uint64
+	// Guards writing the encrypted DB, and the generation it last wrote
+	persistMu sync.Mutex
+	persisted uint64
+	// Balance changes that can still be undone, see Undo
+	pending pendingChanges
+}
+
+// OpenDB opens the DB in dir, which is created if it doesn't exist yet.
+func OpenDB(dir string) (*DB, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "envelopes.sqlite")
+
+	// WAL and a busy timeout let readers and writers wait for each other
+	// instead of failing with "database is locked". A single connection
+	// serializes writes from the web handlers and event merging.
+	dsn := "file:" + path + "?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"
+	passphrase := os.Getenv("ENVELOPES_DB_KEY")
+	if passphrase != "" {
+		// The single connection also keeps the in-memory DB alive
+		dsn = "file::memory:?_busy_timeout=5000&_txlock=immediate"
+	}
+
+	return openDB(dsn, passphrase, path)
+}
+
+// OpenDBWithDSN opens the SQLite DB given by dsn, without encryption. With
+// "file::memory:", the DB only lives as long as the returned DB is open,
+// which is handy for tests.
+func OpenDBWithDSN(dsn string) (*DB, error) {
+	return openDB(dsn, "", "")
 }
 
-func OpenDB() (*DB, error) {
-	db, err := sql.Open("sqlite3", "envelopes.sqlite")
+// openDB opens the DB at dsn. If passphrase is set, dsn has to be an
+// in-memory DB, which is loaded from the encrypted file, or from the plain
+// text one at path if there is no encrypted one yet.
+func openDB(dsn, passphrase, path string) (*DB, error) {
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, err
 	}
+	db.SetMaxOpenConns(1)
 
-	rv := &DB{db, make(chan Event)}
+	rv := &DB{db: db, Events: make(chan Event)}
+
+	migrate := ""
+	if passphrase != "" {
+		rv.encryptedPath = path + ".enc"
+		if migrate, err = rv.loadEncrypted(passphrase, path); err != nil {
+			return nil, err
+		}
+	}
 
 	if err := rv.setup(); err != nil {
 		return nil, err
 	}
 
+	if rv.origin, err = rv.instanceName(); err != nil {
+		return nil, err
+	}
+
+	if err := rv.persist(); err != nil {
+		return nil, err
+	}
+	if migrate != "" {
+		if err := os.Rename(migrate, migrate+".unencrypted"); err != nil {
+			return nil, err
+		}
+		log.Printf(`moved unencrypted DB to %s.unencrypted, delete it once you checked that everything is there`, migrate)
+	}
+
+	if err := rv.stmts.prepare(db); err != nil {
+		return nil, err
+	}
+
+	if err := rv.loadPending(); err != nil {
+		return nil, err
+	}
+
 	var count int64
 	if err := db.QueryRow("SELECT count(*) FROM envelopes WHERE not deleted").Scan(&count); err != nil {
 		return nil, err
@@ -59,6 +410,7 @@ func OpenDB() (*DB, error) {
 }
 
 func (d *DB) Close() error {
+	d.stmts.close()
 	return d.db.Close()
 }
 
@@ -67,6 +419,7 @@ func (d *DB) setup() error {
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
 	if _, err := tx.Exec(`
 		CREATE TABLE IF NOT EXISTS envelopes
@@ -87,21 +440,143 @@ func (d *DB) setup() error {
 		return err
 	}
 
+	// Metadata changes that lost against newer ones, see recordConflictWithTx.
+	// They are only kept locally.
+	if _, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS conflicts
+		(event UUID PRIMARY KEY, envelope UUID, winner UUID,
+		 resolved BOOLEAN DEFAULT 0)`); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS settings
+		(key STRING PRIMARY KEY, value STRING)`); err != nil {
+		return err
+	}
+
+	columns := []struct {
+		table, column, decl string
+	}{
+		{`envelopes`, `metadate`, `DATETIME DEFAULT ''`},
+		{`envelopes`, `metaevent`, `UUID DEFAULT ''`},
+		{`history`, `meta`, `BOOLEAN DEFAULT 0`},
+		{`history`, `prevtarget`, `INTEGER DEFAULT 0`},
+		{`history`, `prevmonthtarget`, `INTEGER DEFAULT 0`},
+		{`envelopes`, `currency`, `STRING DEFAULT ''`},
+		{`history`, `currency`, `STRING DEFAULT ''`},
+		{`history`, `reverses`, `UUID DEFAULT ''`},
+		{`history`, `origin`, `STRING DEFAULT ''`},
+		{`envelopes`, `archived`, `BOOLEAN DEFAULT 0`},
+		{`history`, `archived`, `BOOLEAN DEFAULT 0`},
+		{`history`, `tags`, `STRING DEFAULT ''`},
+		{`envelopes`, `goalamount`, `INTEGER DEFAULT 0`},
+		{`envelopes`, `goaldate`, `STRING DEFAULT ''`},
+		{`history`, `goalamount`, `INTEGER DEFAULT 0`},
+		{`history`, `goaldate`, `STRING DEFAULT ''`},
+		{`history`, `kind`, `STRING DEFAULT ''`},
+		{`envelopes`, `sortorder`, `INTEGER DEFAULT 0`},
+		{`envelopes`, `liability`, `BOOLEAN DEFAULT 0`},
+		{`history`, `liability`, `BOOLEAN DEFAULT 0`},
+		{`envelopes`, `excludetotals`, `BOOLEAN DEFAULT 0`},
+		{`history`, `excludetotals`, `BOOLEAN DEFAULT 0`},
+		{`envelopes`, `owner`, `STRING DEFAULT ''`},
+		{`history`, `owner`, `STRING DEFAULT ''`},
+		{`envelopes`, `autospread`, `STRING DEFAULT ''`},
+		{`history`, `autospread`, `STRING DEFAULT ''`},
+		{`envelopes`, `monthcap`, `INTEGER DEFAULT 0`},
+		{`history`, `monthcap`, `INTEGER DEFAULT 0`},
+		{`history`, `attachment`, `STRING DEFAULT ''`},
+		{`history`, `splitgroup`, `UUID DEFAULT ''`},
+		// Only kept locally, see markPendingWithTx
+		{`history`, `pendinguntil`, `DATETIME DEFAULT ''`},
+		{`history`, `pendinggroup`, `UUID DEFAULT ''`},
+		// The order events were merged in. Unlike rowid, it survives VACUUM.
+		{`history`, `seq`, `INTEGER DEFAULT 0`},
+	}
+	for _, c := range columns {
+		if err := addColumn(tx, c.table, c.column, c.decl); err != nil {
+			return err
+		}
+	}
+
+	// Until there was seq, the rowid kept the order
+	if _, err := tx.Exec(`UPDATE history SET seq = rowid WHERE seq = 0`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS history_seq ON history (seq)`); err != nil {
+		return err
+	}
+
+	// Balance changes from before kinds were recorded are classified by the
+	// comments Transfer and Spread write
+	_, err = tx.Exec(`
+		UPDATE history SET kind = CASE
+			WHEN comment GLOB 'Spread *' OR comment GLOB 'Reversal: Spread *' THEN $1
+			WHEN comment GLOB 'From *' OR comment GLOB 'To *'
+				OR comment GLOB 'Reversal: From *' OR comment GLOB 'Reversal: To *' THEN $2
+			ELSE $3 END
+		WHERE kind = '' AND NOT meta AND NOT deleted`, KindSpread, KindTransfer, KindExternal)
+	if err != nil {
+		return err
+	}
+
+	// Older history entries have dates in the format of SQLite's datetime(),
+	// which is UTC as well
+	_, err = tx.Exec(`
+		UPDATE history SET date = strftime('%Y-%m-%dT%H:%M:%fZ', date)
+		WHERE date NOT GLOB '*T*' AND strftime('%Y-%m-%dT%H:%M:%fZ', date) IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+
 	return tx.Commit()
 }
 
+func addColumn(tx *sql.Tx, table, column, decl string) error {
+	rows, err := tx.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notnull, pk int
+			name, typ        string
+			dflt             sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notnull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	log.Printf(`adding column %s to table %s`, column, table)
+	_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, decl))
+	return err
+}
+
+// AllEnvelopes returns all envelopes that are neither deleted nor archived.
 func (d *DB) AllEnvelopes() []*Envelope {
+	return d.envelopes(false)
+}
+
+func (d *DB) ArchivedEnvelopes() []*Envelope {
+	return d.envelopes(true)
+}
+
+func (d *DB) envelopes(archived bool) []*Envelope {
 	rv := []*Envelope{}
 
-	rows, err := d.db.Query(`
-		SELECT e.id, e.name, e.balance, e.target, e.monthtarget, h.balance
-		FROM envelopes AS e LEFT OUTER JOIN
-			(SELECT envelope, sum(balance) AS balance, date
-			 FROM history
-			 WHERE date > DATE('now', 'start of month')
-			 GROUP BY envelope) AS h
-		ON e.id = h.envelope
-		WHERE not e.deleted`)
+	monthStart := budgetMonthOf(time.Now()).Format(dateFormat)
+	rows, err := d.stmts.allEnvelopes.Query(monthStart, archived)
 	if err != nil {
 		log.Printf(`error querying DB: %v`, err)
 		return nil
@@ -110,14 +585,71 @@ func (d *DB) AllEnvelopes() []*Envelope {
 
 	for rows.Next() {
 		var e Envelope
-		var delta sql.NullInt64
-		if err := rows.Scan(&e.Id, &e.Name, &e.Balance, &e.Target, &e.MonthTarget, &delta); err != nil {
+		var delta, spent sql.NullInt64
+		if err := rows.Scan(&e.Id, &e.Name, &e.Balance, &e.Target, &e.MonthTarget, &e.Currency, &e.GoalAmount, &e.GoalDate, &e.Liability,
+			&e.ExcludeFromTotals, &e.Owner, &e.AutoSpread, &e.MonthCap, &delta, &spent); err != nil {
 			log.Printf(`error querying DB: %v`, err)
 			return nil
 		}
+		e.Archived = archived
+		if e.Currency == "" {
+			e.Currency = defaultCurrency
+		}
 		if delta.Valid {
 			e.MonthDelta = int(delta.Int64)
 		}
+		if spent.Valid {
+			e.MonthSpent = int(spent.Int64)
+		}
+		rv = append(rv, &e)
+	}
+
+	return rv
+}
+
+// MonthSpent returns how much was spent from the envelope with the given ID
+// this month, i.e. what went out of it to external accounts.
+func (d *DB) MonthSpent(id uuid.UUID) (int, error) {
+	var spent int
+	err := d.db.QueryRow(`
+		SELECT -coalesce(sum(h.balance), 0) FROM history AS h
+		WHERE h.envelope = $1 AND datetime(h.date) >= datetime($2) AND `+isSpending,
+		id, budgetMonthOf(time.Now()).Format(dateFormat)).Scan(&spent)
+	return spent, dbError(err)
+}
+
+// EnvelopesAsOf reconstructs the balances of all envelopes that existed and
+// weren't deleted at t from the history. Names and targets are the current
+// ones. MonthDelta is relative to the start of the month of t.
+func (d *DB) EnvelopesAsOf(t time.Time) []*Envelope {
+	rv := []*Envelope{}
+
+	rows, err := d.db.Query(`
+		SELECT e.id, e.name, e.target, e.monthtarget, e.currency, e.archived, e.liability, e.excludetotals, e.owner, e.autospread,
+			e.monthcap, sum(h.balance),
+			sum(CASE WHEN datetime(h.date) >= datetime($1) THEN h.balance ELSE 0 END),
+			-sum(CASE WHEN datetime(h.date) >= datetime($1) AND `+isSpending+` THEN h.balance ELSE 0 END)
+		FROM envelopes AS e JOIN history AS h ON h.envelope = e.id
+		WHERE datetime(h.date) <= datetime($2)
+		GROUP BY e.id
+		HAVING NOT max(h.deleted)
+		ORDER BY e.sortorder, e.name`, budgetMonthOf(t).Format(dateFormat), t.UTC().Format(dateFormat))
+	if err != nil {
+		log.Printf(`error querying DB: %v`, err)
+		return nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e Envelope
+		if err := rows.Scan(&e.Id, &e.Name, &e.Target, &e.MonthTarget, &e.Currency, &e.Archived, &e.Liability, &e.ExcludeFromTotals,
+			&e.Owner, &e.AutoSpread, &e.MonthCap, &e.Balance, &e.MonthDelta, &e.MonthSpent); err != nil {
+			log.Printf(`error querying DB: %v`, err)
+			return nil
+		}
+		if e.Currency == "" {
+			e.Currency = defaultCurrency
+		}
 		rv = append(rv, &e)
 	}
 
@@ -125,53 +657,121 @@ func (d *DB) AllEnvelopes() []*Envelope {
 }
 
 func (d *DB) DeleteEnvelope(id uuid.UUID) error {
-	evt := Event{
+	evt := d.deleteEvent(id)
+
+	d.emit(evt)
+
+	return d.MergeEvent(evt)
+}
+
+func (d *DB) deleteEvent(id uuid.UUID) Event {
+	return Event{
 		EnvelopeId: id,
 		Id:         uuid.New(),
-		Date:       time.Now().String(),
+		Date:       eventDate(),
+		Origin:     d.origin,
 		Deleted:    true,
 	}
+}
 
-	select {
-	case d.Events <- evt:
-		/* Nothing */
-	default:
-		/* Nothing */
+// MergeEnvelopes moves the balance of the envelope srcId to dstId, adds its
+// targets to the ones of dstId and deletes it, all in one transaction. The
+// history of the source stays in the DB.
+func (d *DB) MergeEnvelopes(srcId, dstId uuid.UUID) error {
+	if srcId == dstId {
+		return fmt.Errorf(`%w: can't merge an envelope into itself`, errInvalidValue)
 	}
 
-	return d.MergeEvent(evt)
+	src, err := d.Envelope(srcId)
+	if err != nil {
+		return err
+	}
+	dst, err := d.Envelope(dstId)
+	if err != nil {
+		return err
+	}
+	if src.Currency != dst.Currency {
+		return fmt.Errorf(`%w: can't merge %s into %s`, errInvalidValue, src.Currency, dst.Currency)
+	}
+
+	evts := []Event{}
+	if src.Balance != 0 {
+		evts = append(evts,
+			d.balanceEvent(dst, KindTransfer, src.Balance, fmt.Sprintf(`Merged from %s`, src.Name)),
+			d.balanceEvent(src, KindTransfer, -src.Balance, fmt.Sprintf(`Merged into %s`, dst.Name)))
+	}
+
+	meta, err := d.metaChange(dst, func(e *Envelope) {
+		e.Target += src.Target
+		e.MonthTarget += src.MonthTarget
+	})
+	if err != nil {
+		return err
+	}
+	if meta != nil {
+		evts = append(evts, *meta)
+	}
+
+	evts = append(evts, d.deleteEvent(src.Id))
+
+	return d.mergeAll(evts)
 }
 
+// Envelope returns the envelope with the given ID, or errNotFound if there is
+// none.
 func (d *DB) Envelope(id uuid.UUID) (*Envelope, error) {
 	tx, err := d.db.Begin()
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 	defer tx.Rollback()
 
-	return d.envelopeWithTx(tx, id)
+	e, err := d.envelopeWithTx(tx, id)
+	return e, dbError(err)
 }
 
+// envelopeWithTx returns the envelope with the given ID, or an error wrapping
+// both errNotFound and sql.ErrNoRows if there is none.
 func (d *DB) envelopeWithTx(tx *sql.Tx, id uuid.UUID) (*Envelope, error) {
 	e := Envelope{Id: id}
 
-	err := tx.QueryRow(`
-		SELECT id, name, balance, target, monthtarget
-		FROM envelopes
-		WHERE id = $1 AND not deleted`, id).Scan(&e.Id, &e.Name, &e.Balance, &e.Target, &e.MonthTarget)
-	if err == nil {
-		return &e, nil
+	err := tx.Stmt(d.stmts.envelope).QueryRow(id).Scan(&e.Id, &e.Name, &e.Balance, &e.Target, &e.MonthTarget, &e.Currency, &e.Archived,
+		&e.GoalAmount, &e.GoalDate, &e.Liability, &e.ExcludeFromTotals, &e.Owner,
+		&e.AutoSpread, &e.MonthCap, &e.metaDate, &e.metaEvent)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf(`%w: envelope %s: %w`, errNotFound, id, err)
+	} else if err != nil {
+		return nil, err
+	}
+	if e.Currency == "" {
+		e.Currency = defaultCurrency
+	}
+	return &e, nil
+}
+
+// ensureEnvelopeWithTx is like envelopeWithTx, but creates a blank envelope if
+// there is none with the given ID yet. Events for envelopes we haven't seen
+// before are merged this way.
+func (d *DB) ensureEnvelopeWithTx(tx *sql.Tx, id uuid.UUID) (*Envelope, error) {
+	e, err := d.envelopeWithTx(tx, id)
+	if !errors.Is(err, errNotFound) {
+		return e, err
 	}
 
-	if _, err := tx.Exec(`
-		INSERT INTO envelopes(id, name, balance, target, monthtarget, deleted)
-		VALUES ($1, "", 0, 0, 0, 'false')`, e.Id); err != nil {
+	// Another merge may have created the envelope in the meantime. Don't
+	// fail on that, and use whatever is there now.
+	if _, err := tx.Stmt(d.stmts.insertEnvelope).Exec(id); err != nil {
 		return nil, err
 	}
-	return &e, nil
+	return d.envelopeWithTx(tx, id)
 }
 
 func (d *DB) EnvelopeWithHistory(id uuid.UUID) (*Envelope, []Event, error) {
+	envelope, events, err := d.envelopeWithHistory(id)
+	return envelope, events, dbError(err)
+}
+
+func (d *DB) envelopeWithHistory(id uuid.UUID) (*Envelope, []Event, error) {
 	events := []Event{}
 
 	tx, err := d.db.Begin()
@@ -186,17 +786,18 @@ func (d *DB) EnvelopeWithHistory(id uuid.UUID) (*Envelope, []Event, error) {
 	}
 
 	rows, err := tx.Query(`
-		SELECT id, envelope, date, name, balance, target, monthtarget, comment, deleted
+		SELECT `+eventColumns+`
 		FROM history
-		WHERE envelope = $1`, id)
+		WHERE envelope = $1
+		ORDER BY date, seq`, id)
 	if err != nil {
 		return nil, events, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var e Event
-		if err := rows.Scan(&e.Id, &e.EnvelopeId, &e.Date, &e.Name, &e.Balance, &e.Target, &e.MonthTarget, &e.Comment, &e.Deleted); err != nil {
+		e, err := scanEvent(rows)
+		if err != nil {
 			log.Printf(`can't scan event %s: %s`, e.Id, err)
 		}
 		if e.Deleted {
@@ -209,138 +810,968 @@ func (d *DB) EnvelopeWithHistory(id uuid.UUID) (*Envelope, []Event, error) {
 }
 
 func (d *DB) MergeEvent(e Event) error {
-	log.Printf(`merging event %v`, e.Id)
-
 	tx, err := d.db.Begin()
 	if err != nil {
-		return err
+		return dbError(err)
 	}
 
-	env, err := d.envelopeWithTx(tx, e.EnvelopeId)
-	if err != nil {
+	if err := d.mergeEventWithTx(tx, e); err != nil {
 		tx.Rollback()
-		return err
+		return dbError(err)
 	}
 
-	_, err = tx.Exec(`
-		INSERT INTO history (id, envelope, name, balance, target, monthtarget, comment, deleted, date)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, datetime('now'))`,
-		e.Id, e.EnvelopeId, e.Name, e.Balance, e.Target, e.MonthTarget, e.Comment, e.Deleted)
-	if err != nil {
-		tx.Rollback()
-		return err
+	if err := tx.Commit(); err != nil {
+		return dbError(err)
 	}
+	return dbError(d.persist())
+}
+
+func (d *DB) mergeEventWithTx(tx *sql.Tx, e Event) error {
+	log.Printf(`merging event %v`, e.Id)
 
-	if e.Name == "" {
-		e.Name = env.Name
+	// Keep the date the event was created with, so it is the same
+	// everywhere, even if it is merged much later
+	if e.Date == "" {
+		e.Date = eventDate()
+	} else if date := normalizeDate(e.Date); date != "" {
+		e.Date = date
+	} else {
+		return fmt.Errorf(`%w: event %s has invalid date %q`, errInvalidValue, e.Id, e.Date)
 	}
-	_, err = tx.Exec(`
-		UPDATE envelopes
-		SET name = $1, balance = $2, target = $3, monthtarget = $4, deleted = $5
-		WHERE id = $6`, e.Name, env.Balance+e.Balance, env.Target+e.Target, env.MonthTarget+e.MonthTarget, e.Deleted, env.Id)
+
+	env, err := d.ensureEnvelopeWithTx(tx, e.EnvelopeId)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 
-	return tx.Commit()
-}
-
-func (d *DB) UpdateEnvelopeMeta(id uuid.UUID, name string, newTarget, newMonthTarget int) error {
-	env, err := d.Envelope(id)
-	if err != nil {
+	if err := d.insertEventWithTx(tx, e); err != nil {
 		return err
 	}
 
-	if name == env.Name && newTarget == 0 && newMonthTarget == 0 {
-		return nil
+	if err := d.recordConflictWithTx(tx, env, e); err != nil {
+		return err
 	}
 
-	log.Printf(`dB update meta: dT: %d dMT: %d`, newTarget, newMonthTarget)
+	env.apply(e)
+	_, err = tx.Stmt(d.stmts.updateEnvelope).Exec(env.Name, env.Balance, env.Target, env.MonthTarget, e.Deleted,
+		env.Currency, env.Archived, env.GoalAmount, env.GoalDate, env.Liability, env.ExcludeFromTotals,
+		env.Owner, env.AutoSpread, env.MonthCap, env.metaDate, env.metaEvent, env.Id)
+	return err
+}
 
-	evt := Event{
-		EnvelopeId:  env.Id,
-		Id:          uuid.New(),
-		Date:        time.Now().String(),
-		Name:        name,
-		Balance:     0,
-		Target:      newTarget - env.Target,
-		MonthTarget: newMonthTarget - env.MonthTarget,
-		Deleted:     false,
-		Comment:     "",
-	}
+// insertEventWithTx adds e to the history without applying it.
+func (d *DB) insertEventWithTx(tx *sql.Tx, e Event) error {
+	_, err := tx.Stmt(d.stmts.insertEvent).Exec(
+		e.Id, e.EnvelopeId, e.Name, e.Balance, e.Target, e.MonthTarget, e.Comment, e.Deleted,
+		e.Meta, e.PrevTarget, e.PrevMonthTarget, e.Currency, e.Reverses, e.Origin, e.Archived, strings.Join(e.Tags, ","),
+		e.GoalAmount, e.GoalDate, e.Date, e.Kind, e.Liability, e.ExcludeFromTotals, e.Owner, e.AutoSpread, e.MonthCap,
+		e.Attachment, e.SplitGroup)
+	return err
+}
 
-	select {
-	case d.Events <- evt:
-		/* nothing */
-	default:
-		/* nothing */
+// UpdateEnvelopeMeta calls update with a copy of the envelope and records a
+// metadata event if update changed anything.
+func (d *DB) UpdateEnvelopeMeta(id uuid.UUID, update func(e *Envelope)) error {
+	env, err := d.Envelope(id)
+	if err != nil {
+		return err
 	}
 
-	return d.MergeEvent(evt)
+	return d.updateMeta(env, update)
 }
 
-func (d *DB) UpdateEnvelopeBalance(id uuid.UUID, dBalance int, comment string) error {
+// errStaleVersion is returned when the metadata of an envelope changed since
+// the caller last looked at it.
+var errStaleVersion = errors.New("envelope was changed in the meantime")
+
+// UpdateEnvelopeMetaVersion is like UpdateEnvelopeMeta, but fails with
+// errStaleVersion if the MetaVersion of the envelope is no longer version.
+func (d *DB) UpdateEnvelopeMetaVersion(id uuid.UUID, version string, update func(e *Envelope)) error {
 	env, err := d.Envelope(id)
 	if err != nil {
 		return err
 	}
+	if env.MetaVersion() != version {
+		return errStaleVersion
+	}
 
-	log.Printf(`dB update balance: %d`, dBalance)
+	return d.updateMeta(env, update)
+}
 
-	evt := Event{
-		EnvelopeId:  env.Id,
-		Id:          uuid.New(),
-		Date:        time.Now().String(),
-		Name:        env.Name,
-		Balance:     dBalance,
-		Target:      0,
-		MonthTarget: 0,
-		Deleted:     false,
-		Comment:     comment,
-	}
+// CreateEnvelope creates a new envelope whose metadata is set up by update.
+func (d *DB) CreateEnvelope(update func(e *Envelope)) (uuid.UUID, error) {
+	env := &Envelope{Id: uuid.New(), Currency: defaultCurrency}
+	return env.Id, d.updateMeta(env, update)
+}
 
-	select {
-	case d.Events <- evt:
-		/* nothing */
-	default:
-		/* nothing */
+// CreateEnvelopes is like CreateEnvelope for several envelopes at once. All of
+// them are created in a single transaction.
+func (d *DB) CreateEnvelopes(updates []func(e *Envelope)) ([]uuid.UUID, error) {
+	ids := []uuid.UUID{}
+	evts := []Event{}
+	for _, update := range updates {
+		env := &Envelope{Id: uuid.New(), Currency: defaultCurrency}
+		evt, err := d.metaChange(env, update)
+		if err != nil {
+			return nil, err
+		}
+		if evt == nil {
+			// Nothing set up, not even a name
+			continue
+		}
+		ids = append(ids, env.Id)
+		evts = append(evts, *evt)
 	}
 
-	return d.MergeEvent(evt)
+	if len(evts) == 0 {
+		return ids, nil
+	}
+	return ids, d.mergeAll(evts)
 }
 
-func (d *DB) Spread(id uuid.UUID) error {
-	es := d.AllEnvelopes()
-	toSpread, err := d.Envelope(id)
-
-	if err != nil {
+func (d *DB) updateMeta(env *Envelope, update func(e *Envelope)) error {
+	evt, err := d.metaChange(env, update)
+	if err != nil || evt == nil {
 		return err
 	}
 
-	totalMonthTarget := int(0)
-	for _, e := range es {
-		if e.Id == id {
-			continue
-		}
-		totalMonthTarget += e.MonthTarget
-	}
+	d.emit(*evt)
 
-	for _, e := range es {
-		if e.Id == id || e.MonthTarget == 0 {
-			continue
-		}
+	return d.MergeEvent(*evt)
+}
 
-		pct := float64(e.MonthTarget) / float64(totalMonthTarget)
-		amount := float64(toSpread.Balance) * pct
+// metaChange returns the event for the changes update makes to a copy of env,
+// or nil if it doesn't change anything.
+func (d *DB) metaChange(env *Envelope, update func(e *Envelope)) (*Event, error) {
+	changed := *env
+	update(&changed)
 
-		if err := d.UpdateEnvelopeBalance(e.Id, int(amount), fmt.Sprintf(`Spread from %s`, toSpread.Name)); err != nil {
+	var err error
+	if changed.Name, err = cleanText("name", changed.Name, maxNameLength); err != nil {
+		return nil, err
+	}
+	if changed.GoalDate != "" {
+		if _, err := time.Parse("2006-01-02", changed.GoalDate); err != nil {
+			return nil, fmt.Errorf(`%w: goal date %q is not YYYY-MM-DD`, errInvalidValue, changed.GoalDate)
+		}
+	}
+	switch changed.AutoSpread {
+	case "", SpreadProportional, SpreadEven, SpreadRemaining:
+		/* nothing */
+	default:
+		return nil, fmt.Errorf(`%w: unknown spread mode %q`, errInvalidValue, changed.AutoSpread)
+	}
+	if changed.MonthCap < 0 {
+		return nil, fmt.Errorf(`%w: monthly cap can't be negative`, errInvalidValue)
+	}
+	if changed.sameMeta(env) {
+		return nil, nil
+	}
+
+	log.Printf(`dB update meta: dT: %d dMT: %d`, changed.Target-env.Target, changed.MonthTarget-env.MonthTarget)
+
+	evt := d.metaEvent(env, &changed)
+	return &evt, nil
+}
+
+// UpdateEnvelopesMeta is like UpdateEnvelopeMeta for several envelopes at
+// once. All changes are recorded in a single transaction.
+func (d *DB) UpdateEnvelopesMeta(updates map[uuid.UUID]func(e *Envelope)) error {
+	evts := []Event{}
+	for id, update := range updates {
+		env, err := d.Envelope(id)
+		if err != nil {
 			return err
 		}
-		if err := d.UpdateEnvelopeBalance(id, int(-amount), fmt.Sprintf(`Spread to %s`, e.Name)); err != nil {
+
+		evt, err := d.metaChange(env, update)
+		if err != nil {
 			return err
 		}
+		if evt != nil {
+			evts = append(evts, *evt)
+		}
+	}
+
+	if len(evts) == 0 {
+		return nil
+	}
+
+	return d.mergeAll(evts)
+}
+
+func (d *DB) ArchiveEnvelope(id uuid.UUID) error {
+	return d.UpdateEnvelopeMeta(id, func(e *Envelope) {
+		e.Archived = true
+	})
+}
+
+func (d *DB) UnarchiveEnvelope(id uuid.UUID) error {
+	return d.UpdateEnvelopeMeta(id, func(e *Envelope) {
+		e.Archived = false
+	})
+}
+
+// ReorderEnvelopes moves the envelopes with the given IDs to the given order.
+// The order is only stored locally and doesn't create events, since it is
+// only about how envelopes are shown.
+func (d *DB) ReorderEnvelopes(ids []uuid.UUID) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, id := range ids {
+		if _, err := tx.Exec(`UPDATE envelopes SET sortorder = $1 WHERE id = $2`, i+1, id); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return d.persist()
+}
+
+// CloneEnvelope creates a new, empty envelope named newName with the currency
+// and targets of the one with the given ID. If newName is empty, the new
+// envelope is called "Copy of …".
+func (d *DB) CloneEnvelope(id uuid.UUID, newName string) (uuid.UUID, error) {
+	src, err := d.Envelope(id)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if newName == "" {
+		newName = "Copy of " + src.Name
+	}
+
+	return d.CreateEnvelope(func(e *Envelope) {
+		e.Name = newName
+		e.Currency = src.Currency
+		e.Target = src.Target
+		e.MonthTarget = src.MonthTarget
+		e.Liability = src.Liability
+		e.ExcludeFromTotals = src.ExcludeFromTotals
+		e.Owner = src.Owner
+		e.AutoSpread = src.AutoSpread
+		e.MonthCap = src.MonthCap
+	})
+}
+
+func (d *DB) UpdateEnvelopeBalance(id uuid.UUID, dBalance int, comment string, tags ...string) error {
+	return d.UpdateEnvelopeBalanceAttached(id, dBalance, comment, "", tags...)
+}
+
+// UpdateEnvelopeBalanceAttached is like UpdateEnvelopeBalance, but also
+// records a reference to a receipt, see attachmentRef.
+func (d *DB) UpdateEnvelopeBalanceAttached(id uuid.UUID, dBalance int, comment, attachment string, tags ...string) error {
+	env, err := d.Envelope(id)
+	if err != nil {
+		return err
+	}
+
+	if comment, err = cleanText("comment", comment, maxCommentLength); err != nil {
+		return err
+	}
+	if tags, err = cleanTags(tags); err != nil {
+		return err
+	}
+	if attachment, err = attachmentRef(attachment); err != nil {
+		return err
+	}
+
+	log.Printf(`dB update balance: %d`, dBalance)
+
+	evt := d.balanceEvent(env, KindExternal, dBalance, comment)
+	evt.Tags = tags
+	evt.Attachment = attachment
+	evts := []Event{evt}
+
+	// Only the income is spread, not what was in the envelope before. It is
+	// recorded together with the spread, so both are undone together.
+	if dBalance > 0 && env.AutoSpread != "" {
+		log.Printf(`auto-spreading %d from %s`, dBalance, env.Name)
+		income := *env
+		income.Balance = dBalance
+		// Shared income only goes to shared envelopes
+		plan, err := d.spreadPlan([]*Envelope{&income}, env.AutoSpread, env.Owner)
+		if err != nil {
+			return err
+		}
+		evts = append(evts, d.spreadEvents(env, plan)...)
+	}
+
+	return d.mergeAll(evts)
+}
+
+// balanceEvent returns an event that changes the balance of env by amount.
+func (d *DB) balanceEvent(env *Envelope, kind string, amount int, comment string) Event {
+	return Event{
+		EnvelopeId: env.Id,
+		Id:         uuid.New(),
+		Date:       eventDate(),
+		Origin:     d.origin,
+		Name:       env.Name,
+		Currency:   env.Currency,
+		Balance:    amount,
+		Comment:    comment,
+		Kind:       kind,
+	}
+}
+
+// mergeAll merges evts in a single transaction, so either all or none of them
+// take effect. The events are only emitted once they are committed, and
+// balance changes only once the undo window is over.
+func (d *DB) mergeAll(evts []Event) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback()
+
+	for _, evt := range evts {
+		if err := d.mergeEventWithTx(tx, evt); err != nil {
+			return dbError(err)
+		}
+	}
+	until := pendingUntil(evts)
+	if !until.IsZero() {
+		if err := markPendingWithTx(tx, evts, until); err != nil {
+			return dbError(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(err)
+	}
+	if err := d.persist(); err != nil {
+		return dbError(err)
 	}
 
+	d.hold(evts, until)
+
 	return nil
 }
+
+func (d *DB) emit(evt Event) {
+	select {
+	case d.Events <- evt:
+		/* nothing */
+	default:
+		/* nothing */
+	}
+}
+
+// Transfer moves amount from the envelope src to dst. Both balance changes
+// are recorded in a single transaction, so either both or neither happen.
+func (d *DB) Transfer(srcId, dstId uuid.UUID, amount int, comment string, tags ...string) error {
+	comment, err := cleanText("comment", comment, maxCommentLength)
+	if err != nil {
+		return err
+	}
+	if tags, err = cleanTags(tags); err != nil {
+		return err
+	}
+
+	src, err := d.Envelope(srcId)
+	if err != nil {
+		return err
+	}
+	dst, err := d.Envelope(dstId)
+	if err != nil {
+		return err
+	}
+
+	log.Printf(`dB transfer: %d from %s to %s`, amount, src.Id, dst.Id)
+
+	srccmmt := fmt.Sprintf(`From %s`, src.Name)
+	dstcmmt := fmt.Sprintf(`To %s`, dst.Name)
+	if comment != "" {
+		srccmmt += ": " + comment
+		dstcmmt += ": " + comment
+	}
+
+	evts := []Event{
+		d.balanceEvent(dst, KindTransfer, amount, srccmmt),
+		d.balanceEvent(src, KindTransfer, -amount, dstcmmt),
+	}
+	for i := range evts {
+		evts[i].Tags = tags
+	}
+
+	return d.mergeAll(evts)
+}
+
+// TransferTarget moves amount of the monthly target of the envelope src to
+// dst, leaving their balances alone. Both changes are recorded in a single
+// transaction.
+func (d *DB) TransferTarget(srcId, dstId uuid.UUID, amount int) error {
+	if amount <= 0 {
+		return fmt.Errorf(`%w: amount must be positive`, errInvalidValue)
+	}
+	if srcId == dstId {
+		return fmt.Errorf(`%w: source and destination are the same`, errInvalidValue)
+	}
+
+	src, err := d.Envelope(srcId)
+	if err != nil {
+		return err
+	}
+	dst, err := d.Envelope(dstId)
+	if err != nil {
+		return err
+	}
+	if src.Currency != dst.Currency {
+		return fmt.Errorf(`%w: can't move target from %s to %s`, errInvalidValue, src.Currency, dst.Currency)
+	}
+	if amount > src.MonthTarget {
+		return fmt.Errorf(`%w: monthly target of %s is less than %d`, errInvalidValue, src.Name, amount)
+	}
+
+	log.Printf(`dB transfer target: %d from %s to %s`, amount, src.Id, dst.Id)
+
+	srcEvt, err := d.metaChange(src, func(e *Envelope) { e.MonthTarget -= amount })
+	if err != nil {
+		return err
+	}
+	dstEvt, err := d.metaChange(dst, func(e *Envelope) { e.MonthTarget += amount })
+	if err != nil {
+		return err
+	}
+	srcEvt.Comment = fmt.Sprintf(`Monthly target to %s`, dst.Name)
+	dstEvt.Comment = fmt.Sprintf(`Monthly target from %s`, src.Name)
+
+	return d.mergeAll([]Event{*dstEvt, *srcEvt})
+}
+
+// Event returns the event with the given ID, or errNotFound if there is none.
+func (d *DB) Event(id uuid.UUID) (*Event, error) {
+	e, err := scanEvent(d.db.QueryRow(`SELECT `+eventColumns+` FROM history WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf(`%w: event %s: %w`, errNotFound, id, err)
+	} else if err != nil {
+		return nil, dbError(err)
+	}
+	return &e, nil
+}
+
+// ReverseEvent records an event that undoes the changes of the event with the
+// given ID. The original event stays in the history. Reversing a metadata
+// change restores the targets it replaced.
+func (d *DB) ReverseEvent(eventId uuid.UUID) error {
+	orig, err := d.Event(eventId)
+	if err != nil {
+		return dbError(err)
+	}
+	if orig.Deleted {
+		return fmt.Errorf(`%w: can't reverse deletion of %s`, errInvalidValue, orig.EnvelopeId)
+	}
+	// Reversing one side would leave money that came from nowhere
+	if orig.Kind == KindTransfer || orig.Kind == KindSpread {
+		return fmt.Errorf(`%w: can't reverse one side of a %s, move the money back instead`, errInvalidValue, orig.Kind)
+	}
+	// Pending changes haven't reached anyone else yet, so they are undone
+	// instead of being compensated
+	if d.Pending(eventId) {
+		return fmt.Errorf(`%w: event %s is still pending, undo it instead`, errInvalidValue, eventId)
+	}
+
+	// The check and the reversal are in one transaction, so the event can't
+	// be reversed twice at the same time
+	tx, err := d.db.Begin()
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.QueryRow(`SELECT count(*) FROM history WHERE reverses = $1`, eventId).Scan(&count); err != nil {
+		return dbError(err)
+	}
+	if count != 0 {
+		return fmt.Errorf(`%w: event %s has already been reversed`, errInvalidValue, eventId)
+	}
+
+	env, err := d.envelopeWithTx(tx, orig.EnvelopeId)
+	if err != nil {
+		return dbError(err)
+	}
+
+	comment := `Reversal`
+	if orig.Comment != "" {
+		comment += ": " + orig.Comment
+	}
+
+	evt := Event{
+		EnvelopeId:        env.Id,
+		Id:                uuid.New(),
+		Date:              eventDate(),
+		Origin:            d.origin,
+		Name:              env.Name,
+		Currency:          env.Currency,
+		Archived:          env.Archived,
+		GoalAmount:        env.GoalAmount,
+		GoalDate:          env.GoalDate,
+		Liability:         env.Liability,
+		ExcludeFromTotals: env.ExcludeFromTotals,
+		Owner:             env.Owner,
+		AutoSpread:        env.AutoSpread,
+		MonthCap:          env.MonthCap,
+		Balance:           -orig.Balance,
+		Target:            -orig.Target,
+		MonthTarget:       -orig.MonthTarget,
+		Comment:           comment,
+		Reverses:          orig.Id,
+		// Keep the tags so per-tag sums cancel out
+		Tags: orig.Tags,
+		Kind: orig.Kind,
+	}
+	if orig.Meta {
+		evt.Date = metaDate(env.metaDate)
+		evt.Meta = true
+		evt.PrevTarget = orig.PrevTarget + orig.Target
+		evt.PrevMonthTarget = orig.PrevMonthTarget + orig.MonthTarget
+	}
+
+	if err := d.mergeEventWithTx(tx, evt); err != nil {
+		return dbError(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return dbError(err)
+	}
+	d.emit(evt)
+
+	return dbError(d.persist())
+}
+
+// DailyTotal is the total balance of all envelopes at the end of a day.
+type DailyTotal struct {
+	Date    string `json:"date"`
+	Balance int    `json:"balance"`
+}
+
+// BalancePoint is the balance of an envelope right after the event with the
+// given ID.
+type BalancePoint struct {
+	Date    string    `json:"date"`
+	Event   uuid.UUID `json:"event"`
+	Balance int       `json:"balance"`
+}
+
+// BalanceSeries returns the running balance of the envelope with the given
+// ID after each change of its balance, oldest first.
+func (d *DB) BalanceSeries(id uuid.UUID) ([]BalancePoint, error) {
+	_, events, err := d.EnvelopeWithHistory(id)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []BalancePoint{}
+	balance := 0
+	for _, e := range events {
+		if e.Balance == 0 {
+			continue
+		}
+		balance += e.Balance
+		rv = append(rv, BalancePoint{e.Date, e.Id, balance})
+	}
+
+	return rv, nil
+}
+
+// BalanceTimeSeries returns the total balance of all envelopes in the default
+// currency that user sees for every day from from to to. Transfers and spreads between
+// envelopes cancel out. Deleting an envelope takes its balance out of the
+// total from that day on, so the last value matches the overview. Archived
+// envelopes still count.
+func (d *DB) BalanceTimeSeries(from, to time.Time, user string) ([]DailyTotal, error) {
+	rows, err := d.db.Query(`
+		SELECT h.envelope, date(h.date), h.balance, h.deleted
+		FROM history AS h JOIN envelopes AS e ON h.envelope = e.id
+		WHERE coalesce(nullif(e.currency, ''), $1) = $1 AND date(h.date) <= $2
+			AND ($3 = '' OR e.owner = '' OR e.owner = $3)
+		ORDER BY datetime(h.date), h.seq`, defaultCurrency, to.Format("2006-01-02"), user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := map[uuid.UUID]int{}
+	deleted := map[uuid.UUID]bool{}
+	changes := map[string]int{}
+	start := 0
+	for rows.Next() {
+		var (
+			id      uuid.UUID
+			day     string
+			balance int
+			del     bool
+		)
+		if err := rows.Scan(&id, &day, &balance, &del); err != nil {
+			return nil, err
+		}
+		if deleted[id] {
+			continue
+		}
+
+		change := balance
+		if del {
+			change = -balances[id]
+			deleted[id] = true
+		}
+		balances[id] += balance
+
+		if day < from.Format("2006-01-02") {
+			start += change
+		} else {
+			changes[day] += change
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rv := []DailyTotal{}
+	total := start
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		total += changes[date]
+		rv = append(rv, DailyTotal{date, total})
+	}
+
+	return rv, nil
+}
+
+type SpreadAllocation struct {
+	Envelope *Envelope
+	Amount   int
+	// Part of Amount that is leftover, see spreadLeftover
+	Leftover int
+}
+
+// allocate splits amount proportionally to weights. Rounding differences are
+// handed out by the largest remainder method, so the parts always add up to
+// exactly amount.
+func allocate(amount int, weights []int) []int {
+	parts := make([]int, len(weights))
+	if amount < 0 {
+		for i, p := range allocate(-amount, weights) {
+			parts[i] = -p
+		}
+		return parts
+	}
+
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	if total == 0 {
+		return parts
+	}
+
+	rest := amount
+	remainders := make([]int, len(weights))
+	for i, w := range weights {
+		parts[i] = amount * w / total
+		remainders[i] = amount * w % total
+		rest -= parts[i]
+	}
+
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]] > remainders[order[b]]
+	})
+	for i := 0; i < rest; i++ {
+		parts[order[i]]++
+	}
+
+	return parts
+}
+
+// spreadUnit is the smallest amount, in minor units, that Spread hands out.
+// What can't be split into whole units is leftover.
+var spreadUnit = 1
+
+// Policies for the leftover of a spread: what can't be split into whole
+// spread units and, with SpreadRemaining, whatever isn't needed.
+const (
+	// The rest of the rounding goes to the envelope that lost the most to
+	// it, so nothing is left behind. What isn't needed stays in the source.
+	LeftoverRemainder = "remainder"
+	// Stays in the spread envelope
+	LeftoverSource = "source"
+	// Goes to the envelope spreadSavings
+	LeftoverSavings = "savings"
+)
+
+var (
+	spreadLeftover = LeftoverRemainder
+	spreadSavings  uuid.UUID
+)
+
+// allocateUnits is like allocate, but only hands out multiples of unit. It
+// returns the rest that couldn't be handed out, and the index of the part
+// that lost the most to rounding, or -1 if no part has a weight.
+func allocateUnits(amount int, weights []int, unit int) (parts []int, rest int, largest int) {
+	if amount < 0 {
+		parts, rest, largest = allocateUnits(-amount, weights, unit)
+		for i := range parts {
+			parts[i] = -parts[i]
+		}
+		return parts, -rest, largest
+	}
+
+	parts = allocate(amount/max(unit, 1), weights)
+	exact := allocate(amount, weights)
+	rest = amount
+	largest = -1
+	for i := range parts {
+		parts[i] *= max(unit, 1)
+		rest -= parts[i]
+		if weights[i] > 0 && (largest < 0 || exact[i]-parts[i] > exact[largest]-parts[largest]) {
+			largest = i
+		}
+	}
+
+	return parts, rest, largest
+}
+
+// allocateRounded is like allocate, but all parts except the largest are
+// multiples of unit.
+func allocateRounded(amount int, weights []int, unit int) []int {
+	parts, rest, _ := allocateUnits(amount, weights, unit)
+	largest := -1
+	for i, w := range weights {
+		if w > 0 && (largest < 0 || w > weights[largest]) {
+			largest = i
+		}
+	}
+	if largest >= 0 {
+		parts[largest] += rest
+	}
+	return parts
+}
+
+// Spread modes
+const (
+	// Proportional to the monthly targets. Envelopes without a monthly
+	// target get nothing, and if no envelope has one, nothing is spread.
+	SpreadProportional = "proportional"
+	// Equal parts for all envelopes
+	SpreadEven = "even"
+	// Proportional to what is still missing to the monthly targets, but no
+	// more than that. Whatever is left over stays in the spread envelope.
+	SpreadRemaining = "remaining"
+)
+
+// SpreadPlan computes how Spread would distribute the balance of the envelope
+// with the given ID, without changing anything. Only active envelopes in the
+// same currency that user sees get a share. Without a user, only shared
+// envelopes do.
+func (d *DB) SpreadPlan(id uuid.UUID, mode, user string) ([]SpreadAllocation, error) {
+	return d.SpreadPlanFrom([]uuid.UUID{id}, mode, user)
+}
+
+// SpreadPlanFrom is like SpreadPlan, but pools the balances of all envelopes
+// with the given IDs. None of them get a share.
+func (d *DB) SpreadPlanFrom(ids []uuid.UUID, mode, user string) ([]SpreadAllocation, error) {
+	sources, err := d.spreadSources(ids)
+	if err != nil {
+		return nil, err
+	}
+	return d.spreadPlan(sources, mode, user)
+}
+
+// spreadSources loads the envelopes with the given IDs, skipping duplicates.
+// They all have to be in the same currency.
+func (d *DB) spreadSources(ids []uuid.UUID) ([]*Envelope, error) {
+	sources := []*Envelope{}
+	seen := map[uuid.UUID]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		e, err := d.Envelope(id)
+		if err != nil {
+			return nil, err
+		}
+		if len(sources) > 0 && e.Currency != sources[0].Currency {
+			return nil, fmt.Errorf(`%w: can't spread %s and %s together`, errInvalidValue, sources[0].Currency, e.Currency)
+		}
+		sources = append(sources, e)
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf(`%w: nothing to spread from`, errInvalidValue)
+	}
+	return sources, nil
+}
+
+// spreadPlan distributes the pooled balance of sources over the envelopes user
+// sees, or the shared ones if there is no user.
+func (d *DB) spreadPlan(sources []*Envelope, mode, user string) ([]SpreadAllocation, error) {
+	isSource := map[uuid.UUID]bool{}
+	pool := 0
+	for _, e := range sources {
+		isSource[e.Id] = true
+		pool += e.Balance
+	}
+
+	targets := []*Envelope{}
+	weights := []int{}
+	for _, e := range d.AllEnvelopes() {
+		if isSource[e.Id] || e.Currency != sources[0].Currency {
+			continue
+		}
+		// Nobody chose to put money into someone else's envelopes
+		if !e.VisibleTo(user) || (user == "" && e.Owner != "") {
+			continue
+		}
+		switch mode {
+		case SpreadProportional:
+			if e.MonthTarget <= 0 {
+				continue
+			}
+			weights = append(weights, e.MonthTarget)
+		case SpreadEven:
+			weights = append(weights, 1)
+		case SpreadRemaining:
+			if e.MonthRemaining() <= 0 {
+				continue
+			}
+			weights = append(weights, e.MonthRemaining())
+		default:
+			return nil, fmt.Errorf(`unknown spread mode %q`, mode)
+		}
+		targets = append(targets, e)
+	}
+
+	amount, unneeded := pool, 0
+	if mode == SpreadRemaining {
+		// Only hand out money, and no more than is needed. If there is
+		// enough, everyone gets exactly what's missing.
+		need := 0
+		for _, w := range weights {
+			need += w
+		}
+		amount = min(max(amount, 0), need)
+		unneeded = max(pool-amount, 0)
+	}
+
+	parts, rest, largest := allocateUnits(amount, weights, spreadUnit)
+	leftovers := make([]int, len(parts))
+	switch spreadLeftover {
+	case LeftoverRemainder:
+		if largest >= 0 {
+			parts[largest] += rest
+			leftovers[largest] = rest
+		}
+	case LeftoverSavings:
+		if rest+unneeded == 0 || isSource[spreadSavings] {
+			break
+		}
+		i := slices.IndexFunc(targets, func(e *Envelope) bool { return e.Id == spreadSavings })
+		if i < 0 {
+			savings, err := d.Envelope(spreadSavings)
+			if errors.Is(err, errNotFound) || (err == nil && savings.Currency != sources[0].Currency) {
+				return nil, fmt.Errorf(`%w: no savings envelope in %s for the leftover`, errInvalidValue, sources[0].Currency)
+			} else if err != nil {
+				return nil, err
+			}
+			targets = append(targets, savings)
+			parts = append(parts, 0)
+			leftovers = append(leftovers, 0)
+			i = len(targets) - 1
+		}
+		parts[i] += rest + unneeded
+		leftovers[i] = rest + unneeded
+	}
+
+	plan := []SpreadAllocation{}
+	for i, amount := range parts {
+		if amount == 0 {
+			continue
+		}
+		plan = append(plan, SpreadAllocation{targets[i], amount, leftovers[i]})
+	}
+
+	return plan, nil
+}
+
+// Spread distributes the balance of the envelope with the given ID according
+// to SpreadPlan. All balance changes are recorded in a single transaction.
+func (d *DB) Spread(id uuid.UUID, mode, user string) error {
+	return d.SpreadFrom([]uuid.UUID{id}, mode, user)
+}
+
+// spreadEvents returns the balance changes that move the allocations of plan
+// out of toSpread.
+func (d *DB) spreadEvents(toSpread *Envelope, plan []SpreadAllocation) []Event {
+	evts := []Event{}
+	for _, a := range plan {
+		evts = append(evts,
+			d.balanceEvent(a.Envelope, KindSpread, a.Amount, fmt.Sprintf(`Spread from %s`, toSpread.Name)),
+			d.balanceEvent(toSpread, KindSpread, -a.Amount, fmt.Sprintf(`Spread to %s`, a.Envelope.Name)))
+	}
+	return evts
+}
+
+// SpreadFrom distributes the pooled balance of the envelopes with the given
+// IDs according to SpreadPlanFrom. If all of the pool is handed out, every
+// source ends up empty. Otherwise, the sources with money give in proportion
+// to their balance.
+func (d *DB) SpreadFrom(ids []uuid.UUID, mode, user string) error {
+	sources, err := d.spreadSources(ids)
+	if err != nil {
+		return err
+	}
+
+	plan, err := d.spreadPlan(sources, mode, user)
+	if err != nil {
+		return err
+	}
+
+	if len(sources) == 1 {
+		return d.mergeAll(d.spreadEvents(sources[0], plan))
+	}
+
+	evts := []Event{}
+
+	names := []string{}
+	pool, spent := 0, 0
+	for _, e := range sources {
+		names = append(names, e.Name)
+		pool += e.Balance
+	}
+	for _, a := range plan {
+		evts = append(evts, d.balanceEvent(a.Envelope, KindSpread, a.Amount,
+			fmt.Sprintf(`Spread from %s`, strings.Join(names, ", "))))
+		spent += a.Amount
+	}
+
+	debits := []int{}
+	if spent == pool {
+		for _, e := range sources {
+			debits = append(debits, e.Balance)
+		}
+	} else {
+		weights := []int{}
+		for _, e := range sources {
+			weights = append(weights, max(e.Balance, 0))
+		}
+		debits = allocateRounded(spent, weights, 1)
+	}
+	for i, e := range sources {
+		if debits[i] == 0 {
+			continue
+		}
+		evts = append(evts, d.balanceEvent(e, KindSpread, -debits[i], fmt.Sprintf(`Spread to %d envelopes`, len(plan))))
+	}
+
+	return d.mergeAll(evts)
+}
@@ -0,0 +1,1344 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func newTestDB(t testing.TB) *DB {
+	t.Helper()
+
+	db, err := OpenDBWithDSN("file::memory:?_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+func newTestEnvelope(t testing.TB, db *DB, name string, monthTarget int) uuid.UUID {
+	t.Helper()
+
+	id, err := db.CreateEnvelope(func(e *Envelope) {
+		e.Name = name
+		e.MonthTarget = monthTarget
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func mustEnvelope(t testing.TB, db *DB, id uuid.UUID) *Envelope {
+	t.Helper()
+
+	e, err := db.Envelope(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func BenchmarkAllEnvelopes(b *testing.B) {
+	db := newTestDB(b)
+
+	envs := []*Envelope{}
+	for i := 0; i < 50; i++ {
+		envs = append(envs, mustEnvelope(b, db, newTestEnvelope(b, db, fmt.Sprintf(`envelope %d`, i), 100)))
+	}
+	evts := []Event{}
+	for i := 0; i < 5000; i++ {
+		evts = append(evts, db.balanceEvent(envs[i%len(envs)], KindExternal, i%200-100, ""))
+	}
+	if err := db.mergeAll(evts); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if envs := db.AllEnvelopes(); len(envs) != 50 {
+			b.Fatalf(`got %d envelopes, want 50`, len(envs))
+		}
+	}
+}
+
+func TestMergeEventBalance(t *testing.T) {
+	db := newTestDB(t)
+	id := newTestEnvelope(t, db, "food", 0)
+
+	for _, amount := range []int{1000, -250, 50} {
+		err := db.MergeEvent(Event{Id: uuid.New(), EnvelopeId: id, Balance: amount, Kind: KindExternal})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if e := mustEnvelope(t, db, id); e.Balance != 800 {
+		t.Errorf(`balance is %d, want 800`, e.Balance)
+	}
+}
+
+func TestMergeEventUnknownEnvelope(t *testing.T) {
+	db := newTestDB(t)
+	id := uuid.New()
+
+	err := db.MergeEvent(Event{Id: uuid.New(), EnvelopeId: id, Balance: 100, Kind: KindExternal})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e := mustEnvelope(t, db, id); e.Balance != 100 {
+		t.Errorf(`balance is %d, want 100`, e.Balance)
+	}
+}
+
+func TestMergeEventMetaLastWriterWins(t *testing.T) {
+	db := newTestDB(t)
+	id := newTestEnvelope(t, db, "food", 0)
+	now := time.Now().UTC()
+
+	newer := Event{
+		Id: uuid.New(), EnvelopeId: id, Meta: true, Name: "groceries", Target: 500,
+		Date: now.Add(time.Hour).Format(dateFormat),
+	}
+	older := Event{
+		Id: uuid.New(), EnvelopeId: id, Meta: true, Name: "snacks", Target: 100,
+		Date: now.Add(time.Minute).Format(dateFormat),
+	}
+
+	// The older change arrives last, but must not win
+	for _, evt := range []Event{newer, older} {
+		if err := db.MergeEvent(evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e := mustEnvelope(t, db, id)
+	if e.Name != "groceries" || e.Target != 500 {
+		t.Errorf(`got name %q and target %d, want "groceries" and 500`, e.Name, e.Target)
+	}
+}
+
+func TestSpread(t *testing.T) {
+	tests := []struct {
+		mode      string
+		want      [2]int
+		remaining int
+	}{
+		{SpreadProportional, [2]int{100, 300}, 0},
+		{SpreadEven, [2]int{200, 200}, 0},
+		// Only what's missing to the monthly targets
+		{SpreadRemaining, [2]int{100, 300}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			db := newTestDB(t)
+			src := newTestEnvelope(t, db, "income", 0)
+			a := newTestEnvelope(t, db, "a", 100)
+			b := newTestEnvelope(t, db, "b", 300)
+
+			if err := db.UpdateEnvelopeBalance(src, 400, ""); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Spread(src, tt.mode, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			got := [2]int{mustEnvelope(t, db, a).Balance, mustEnvelope(t, db, b).Balance}
+			if got != tt.want {
+				t.Errorf(`balances are %v, want %v`, got, tt.want)
+			}
+			if e := mustEnvelope(t, db, src); e.Balance != tt.remaining {
+				t.Errorf(`%d left to spread, want %d`, e.Balance, tt.remaining)
+			}
+		})
+	}
+}
+
+func TestAllEnvelopesMonthDelta(t *testing.T) {
+	db := newTestDB(t)
+	id := newTestEnvelope(t, db, "food", 0)
+
+	// Last year's money counts for the balance, but not for this month
+	old := Event{
+		Id: uuid.New(), EnvelopeId: id, Balance: 1000, Kind: KindExternal,
+		Date: time.Now().AddDate(-1, 0, 0).UTC().Format(dateFormat),
+	}
+	if err := db.MergeEvent(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateEnvelopeBalance(id, -300, "this month"); err != nil {
+		t.Fatal(err)
+	}
+
+	envelopes := db.AllEnvelopes()
+	if len(envelopes) != 1 {
+		t.Fatalf(`got %d envelopes, want 1`, len(envelopes))
+	}
+	if e := envelopes[0]; e.Balance != 700 || e.MonthDelta != -300 {
+		t.Errorf(`got balance %d and month delta %d, want 700 and -300`, e.Balance, e.MonthDelta)
+	}
+}
+
+func TestEnvelopeWithHistory(t *testing.T) {
+	db := newTestDB(t)
+	id := newTestEnvelope(t, db, "food", 0)
+	other := newTestEnvelope(t, db, "other", 0)
+
+	for _, comment := range []string{"first", "second"} {
+		if err := db.UpdateEnvelopeBalance(id, 100, comment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.UpdateEnvelopeBalance(other, 100, "elsewhere"); err != nil {
+		t.Fatal(err)
+	}
+
+	e, events, err := db.EnvelopeWithHistory(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Balance != 200 {
+		t.Errorf(`balance is %d, want 200`, e.Balance)
+	}
+
+	// The creation of the envelope, then the balance changes, oldest first
+	comments := []string{}
+	for _, evt := range events {
+		if evt.EnvelopeId != id {
+			t.Errorf(`event %s belongs to %s`, evt.Id, evt.EnvelopeId)
+		}
+		if !evt.Meta {
+			comments = append(comments, evt.Comment)
+		}
+	}
+	if len(events) != 3 || len(comments) != 2 || comments[0] != "first" || comments[1] != "second" {
+		t.Errorf(`got %d events with comments %v`, len(events), comments)
+	}
+}
+
+func TestEvent(t *testing.T) {
+	db := newTestDB(t)
+	id := newTestEnvelope(t, db, "food", 0)
+
+	evt := Event{Id: uuid.New(), EnvelopeId: id, Balance: 100, Comment: "coffee", Tags: []string{"treats"}, Kind: KindExternal}
+	if err := db.MergeEvent(evt); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.Event(evt.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.EnvelopeId != id || got.Balance != 100 || got.Comment != "coffee" || len(got.Tags) != 1 {
+		t.Errorf(`got %+v`, got)
+	}
+
+	if _, err := db.Event(uuid.New()); !errors.Is(err, errNotFound) {
+		t.Errorf(`unknown event: got %v, want errNotFound`, err)
+	}
+}
+
+func TestAllocateRounded(t *testing.T) {
+	tests := []struct {
+		amount  int
+		weights []int
+		unit    int
+		want    []int
+	}{
+		{1000, []int{1, 1, 1}, 1, []int{334, 333, 333}},
+		{1000, []int{1, 1, 1}, 100, []int{400, 300, 300}},
+		{1050, []int{1, 2, 1}, 100, []int{300, 550, 200}},
+		{-1050, []int{1, 2, 1}, 100, []int{-300, -550, -200}},
+		// Less than a unit all goes to the largest share
+		{99, []int{1, 3}, 100, []int{0, 99}},
+		{500, []int{0, 0}, 100, []int{0, 0}},
+	}
+
+	for _, tt := range tests {
+		got := allocateRounded(tt.amount, tt.weights, tt.unit)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf(`allocateRounded(%d, %v, %d) = %v, want %v`, tt.amount, tt.weights, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestSpreadRounded(t *testing.T) {
+	spreadUnit = 100
+	defer func() {
+		spreadUnit = 1
+	}()
+
+	db := newTestDB(t)
+	src := newTestEnvelope(t, db, "income", 0)
+	a := newTestEnvelope(t, db, "a", 100)
+	b := newTestEnvelope(t, db, "b", 300)
+
+	if err := db.UpdateEnvelopeBalance(src, 1234, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Spread(src, SpreadProportional, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := mustEnvelope(t, db, src); e.Balance != 0 {
+		t.Errorf(`%d left to spread, want 0`, e.Balance)
+	}
+	if e := mustEnvelope(t, db, a); e.Balance != 300 {
+		t.Errorf(`a got %d, want 300`, e.Balance)
+	}
+	if e := mustEnvelope(t, db, b); e.Balance != 934 {
+		t.Errorf(`b got %d, want 934`, e.Balance)
+	}
+}
+
+func TestSpreadLeftover(t *testing.T) {
+	spreadUnit = 100
+	defer func() {
+		spreadUnit = 1
+		spreadLeftover = LeftoverRemainder
+		spreadSavings = uuid.Nil
+	}()
+
+	db := newTestDB(t)
+	src := newTestEnvelope(t, db, "income", 0)
+	a := newTestEnvelope(t, db, "a", 100)
+	b := newTestEnvelope(t, db, "b", 300)
+	savings := newTestEnvelope(t, db, "savings", 0)
+	if err := db.UpdateEnvelopeBalance(src, 1234, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy string
+		mode   string
+		// Amounts for a, b and savings, and the leftover among them
+		want     [3]int
+		leftover int
+	}{
+		{LeftoverRemainder, SpreadProportional, [3]int{300, 934, 0}, 34},
+		{LeftoverSource, SpreadProportional, [3]int{300, 900, 0}, 0},
+		{LeftoverSavings, SpreadProportional, [3]int{300, 900, 34}, 34},
+		// Nothing is needed yet, so all of it is leftover
+		{LeftoverSource, SpreadRemaining, [3]int{100, 300, 0}, 0},
+		{LeftoverSavings, SpreadRemaining, [3]int{100, 300, 834}, 834},
+	}
+
+	spreadSavings = savings
+	for _, tt := range tests {
+		spreadLeftover = tt.policy
+		plan, err := db.SpreadPlan(src, tt.mode, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, leftover := [3]int{}, 0
+		for _, alloc := range plan {
+			switch alloc.Envelope.Id {
+			case a:
+				got[0] = alloc.Amount
+			case b:
+				got[1] = alloc.Amount
+			case savings:
+				got[2] = alloc.Amount
+			}
+			leftover += alloc.Leftover
+		}
+		if got != tt.want || leftover != tt.leftover {
+			t.Errorf(`%s, %s: got %v with %d leftover, want %v with %d`, tt.policy, tt.mode, got, leftover, tt.want, tt.leftover)
+		}
+	}
+
+	spreadSavings = uuid.New()
+	if _, err := db.SpreadPlan(src, SpreadProportional, ""); !errors.Is(err, errInvalidValue) {
+		t.Errorf(`unknown savings envelope: got %v, want errInvalidValue`, err)
+	}
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestEnvelope(t, db, "a", 100)
+	b := newTestEnvelope(t, db, "b", 0)
+
+	if err := db.UpdateEnvelopeBalance(a, 500, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Transfer(a, b, 200, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateEnvelopeMeta(b, func(e *Envelope) { e.Target = 300 }); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.VerifyIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Fatalf(`got discrepancies %+v in a consistent DB`, found)
+	}
+
+	if _, err := db.db.Exec(`UPDATE envelopes SET balance = balance + 1 WHERE id = $1`, b); err != nil {
+		t.Fatal(err)
+	}
+	found, err = db.VerifyIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Discrepancy{EnvelopeId: b, Name: "b", Field: "balance", Stored: 201, Computed: 200}
+	if len(found) != 1 || found[0] != want {
+		t.Errorf(`got %+v, want %+v`, found, want)
+	}
+}
+
+func TestRebuildFromHistory(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestEnvelope(t, db, "a", 100)
+	b := newTestEnvelope(t, db, "b", 0)
+
+	if err := db.UpdateEnvelopeBalance(a, 500, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateEnvelopeBalance(b, 300, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.db.Exec(`UPDATE envelopes SET balance = 0, monthtarget = 7`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.RebuildFromHistory(a); err != nil {
+		t.Fatal(err)
+	}
+	if e := mustEnvelope(t, db, a); e.Balance != 500 || e.MonthTarget != 100 {
+		t.Errorf(`a has balance %d and monthly target %d, want 500 and 100`, e.Balance, e.MonthTarget)
+	}
+	if e := mustEnvelope(t, db, b); e.Balance != 0 {
+		t.Errorf(`b was rebuilt too`)
+	}
+
+	var events int
+	if err := db.db.QueryRow(`SELECT count(*) FROM history`).Scan(&events); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RebuildAllFromHistory(); err != nil {
+		t.Fatal(err)
+	}
+	found, err := db.VerifyIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Errorf(`got discrepancies %+v after rebuilding`, found)
+	}
+
+	var after int
+	if err := db.db.QueryRow(`SELECT count(*) FROM history`).Scan(&after); err != nil {
+		t.Fatal(err)
+	}
+	if after != events {
+		t.Errorf(`rebuilding added %d events`, after-events)
+	}
+}
+
+func TestAutoSpread(t *testing.T) {
+	db := newTestDB(t)
+	src := newTestEnvelope(t, db, "income", 0)
+	a := newTestEnvelope(t, db, "a", 100)
+	b := newTestEnvelope(t, db, "b", 300)
+
+	if err := db.UpdateEnvelopeMeta(src, func(e *Envelope) { e.AutoSpread = "sideways" }); !errors.Is(err, errInvalidValue) {
+		t.Errorf(`unknown mode: got %v, want errInvalidValue`, err)
+	}
+	// Money that was there before stays where it is
+	if err := db.UpdateEnvelopeBalance(src, 1000, "savings"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateEnvelopeMeta(src, func(e *Envelope) { e.AutoSpread = SpreadProportional }); err != nil {
+		t.Fatal(err)
+	}
+
+	// Income is spread right away, expenses aren't
+	if err := db.UpdateEnvelopeBalance(src, 400, "salary"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateEnvelopeBalance(src, -50, "fees"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := [3]int{mustEnvelope(t, db, src).Balance, mustEnvelope(t, db, a).Balance, mustEnvelope(t, db, b).Balance}
+	if want := [3]int{950, 100, 300}; got != want {
+		t.Errorf(`balances are %v, want %v`, got, want)
+	}
+
+	// Undoing the income undoes its spread
+	defer func(w time.Duration) { undoWindow = w }(undoWindow)
+	undoWindow = time.Hour
+	if err := db.UpdateEnvelopeBalance(src, 400, "salary"); err != nil {
+		t.Fatal(err)
+	}
+	_, history, err := db.EnvelopeWithHistory(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range history {
+		if e.Comment == "salary" && db.Pending(e.Id) {
+			if err := db.Undo(e.Id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	got = [3]int{mustEnvelope(t, db, src).Balance, mustEnvelope(t, db, a).Balance, mustEnvelope(t, db, b).Balance}
+	if want := [3]int{950, 100, 300}; got != want {
+		t.Errorf(`balances are %v after undoing the income, want %v`, got, want)
+	}
+}
+
+func TestMonthCap(t *testing.T) {
+	db := newTestDB(t)
+	id := newTestEnvelope(t, db, "dining", 0)
+	other := newTestEnvelope(t, db, "other", 0)
+
+	if err := db.UpdateEnvelopeMeta(id, func(e *Envelope) { e.MonthCap = -1 }); !errors.Is(err, errInvalidValue) {
+		t.Errorf(`negative cap: got %v, want errInvalidValue`, err)
+	}
+	if err := db.UpdateEnvelopeMeta(id, func(e *Envelope) { e.MonthCap = 150 }); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only money going out counts, not transfers or reversed spending
+	if err := db.UpdateEnvelopeBalance(id, 500, "funding"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Transfer(id, other, 200, "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateEnvelopeBalance(id, -120, "dinner"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateEnvelopeBalance(id, -80, "lunch"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateEnvelopeBalance(id, -90, "oops"); err != nil {
+		t.Fatal(err)
+	}
+	_, events, err := db.EnvelopeWithHistory(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cap change can be dated after the spending, so look for it by comment
+	for _, e := range events {
+		if e.Comment == "oops" {
+			if err := db.ReverseEvent(e.Id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	spent, err := db.MonthSpent(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spent != 200 {
+		t.Errorf(`spent %d, want 200`, spent)
+	}
+
+	for _, e := range db.AllEnvelopes() {
+		if e.Id == id && (e.MonthSpent != 200 || !e.OverCap()) {
+			t.Errorf(`overview: spent %d of %d, over cap: %v`, e.MonthSpent, e.MonthCap, e.OverCap())
+		}
+		if e.Id == other && e.OverCap() {
+			t.Errorf(`envelope without cap is over it`)
+		}
+	}
+}
+
+func TestAttachment(t *testing.T) {
+	db := newTestDB(t)
+	id := newTestEnvelope(t, db, "food", 0)
+
+	for _, ref := range []string{"../envelopes.sqlite", ".hidden", "javascript:alert(1)", "dir/receipt.pdf"} {
+		if err := db.UpdateEnvelopeBalanceAttached(id, -100, "", ref); !errors.Is(err, errInvalidValue) {
+			t.Errorf(`attachment %q: got %v, want errInvalidValue`, ref, err)
+		}
+	}
+
+	for _, ref := range []string{"https://example.com/receipt?id=1", "receipt.pdf"} {
+		if err := db.UpdateEnvelopeBalanceAttached(id, -100, "", ref); err != nil {
+			t.Fatal(err)
+		}
+		_, events, err := db.EnvelopeWithHistory(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := events[len(events)-1].Attachment; got != ref {
+			t.Errorf(`attachment is %q, want %q`, got, ref)
+		}
+	}
+}
+
+func TestRecentEvents(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestEnvelope(t, db, "a", 0)
+	b := newTestEnvelope(t, db, "b", 0)
+
+	for i, id := range []uuid.UUID{a, b, a} {
+		if err := db.UpdateEnvelopeBalance(id, i+1, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.UpdateEnvelopeMeta(a, func(e *Envelope) { e.Name = "renamed" }); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := db.RecentEvents(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, e := range events {
+		got = append(got, fmt.Sprintf(`%s %d`, e.Name, e.Balance))
+	}
+	if want := []string{"renamed 3", "b 2"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf(`recent events are %v, want %v`, got, want)
+	}
+}
+
+func TestSplitTx(t *testing.T) {
+	db := newTestDB(t)
+	groceries := newTestEnvelope(t, db, "groceries", 0)
+	household := newTestEnvelope(t, db, "household", 0)
+
+	legs := []SplitLeg{{groceries, 6000}, {household, 2000}}
+	if _, err := db.SplitTx(8100, legs, "store"); !errors.Is(err, errInvalidTx) {
+		t.Errorf(`wrong total: got %v, want errInvalidTx`, err)
+	}
+	if _, err := db.SplitTx(12000, append(legs, SplitLeg{groceries, 4000}), "store"); !errors.Is(err, errInvalidTx) {
+		t.Errorf(`envelope twice: got %v, want errInvalidTx`, err)
+	}
+	if b := mustEnvelope(t, db, groceries).Balance; b != 0 {
+		t.Fatalf(`refused split changed the balance to %d`, b)
+	}
+
+	group, err := db.SplitTx(8000, legs, "store", "trip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := db.SplitEvents(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf(`split has %d events, want 2`, len(events))
+	}
+	for i, e := range events {
+		if e.EnvelopeId != legs[i].EnvelopeId || e.Balance != -legs[i].Amount || e.Kind != KindExternal || !e.IsSplit() {
+			t.Errorf(`leg %d is %+v`, i, e)
+		}
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	db := newTestDB(t)
+
+	_, err := db.Envelope(uuid.New())
+	if !errors.Is(err, errNotFound) || !errors.Is(err, sql.ErrNoRows) || errorStatus(err) != 404 {
+		t.Errorf(`unknown envelope: got %v`, err)
+	}
+	if _, err := db.Event(uuid.New()); !errors.Is(err, errNotFound) || !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf(`unknown event: got %v`, err)
+	}
+
+	id := newTestEnvelope(t, db, "food", 0)
+	err = db.UpdateEnvelopeMeta(id, func(e *Envelope) { e.GoalDate = "someday" })
+	if !errors.Is(err, errInvalidValue) || errorStatus(err) != 400 {
+		t.Errorf(`invalid goal date: got %v`, err)
+	}
+
+	if err := db.ReverseEvent(uuid.New()); !errors.Is(err, errNotFound) || errorStatus(err) != 404 {
+		t.Errorf(`reversing an unknown event: got %v`, err)
+	}
+	if err := db.UpdateEnvelopeBalance(id, 10, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, history, err := db.EnvelopeWithHistory(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range history {
+		if e.Balance != 10 {
+			continue
+		}
+		if err := db.ReverseEvent(e.Id); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.ReverseEvent(e.Id); !errors.Is(err, errInvalidValue) || errorStatus(err) != 400 {
+			t.Errorf(`reversing twice: got %v`, err)
+		}
+	}
+
+	db.Close()
+	if _, err := db.Envelope(id); !errors.Is(err, errStorage) || errorStatus(err) != 500 {
+		t.Errorf(`closed DB: got %v`, err)
+	}
+}
+
+func TestSpreadOwners(t *testing.T) {
+	db := newTestDB(t)
+	src := newTestEnvelope(t, db, "income", 0)
+	shared := newTestEnvelope(t, db, "rent", 100)
+	mine := newTestEnvelope(t, db, "alice's", 100)
+	theirs := newTestEnvelope(t, db, "bob's", 100)
+	for id, owner := range map[uuid.UUID]string{mine: "alice", theirs: "bob"} {
+		if err := db.UpdateEnvelopeMeta(id, func(e *Envelope) { e.Owner = owner }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Spreading shared money only reaches what the user sees
+	if err := db.UpdateEnvelopeBalance(src, 300, ""); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := db.SpreadPlan(src, SpreadProportional, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range plan {
+		if a.Envelope.Id == theirs {
+			t.Errorf(`plan for alice includes bob's envelope: %+v`, a)
+		}
+	}
+	if err := db.Spread(src, SpreadProportional, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if e := mustEnvelope(t, db, theirs); e.Balance != 0 {
+		t.Errorf(`bob's envelope got %d from alice's spread`, e.Balance)
+	}
+
+	// Shared income is only spread over shared envelopes
+	if err := db.UpdateEnvelopeMeta(src, func(e *Envelope) { e.AutoSpread = SpreadProportional }); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateEnvelopeBalance(src, 200, "salary"); err != nil {
+		t.Fatal(err)
+	}
+	got := [3]int{mustEnvelope(t, db, shared).Balance, mustEnvelope(t, db, mine).Balance, mustEnvelope(t, db, theirs).Balance}
+	if want := [3]int{350, 150, 0}; got != want {
+		t.Errorf(`balances are %v, want %v`, got, want)
+	}
+}
+
+func TestBalanceTimeSeriesOwner(t *testing.T) {
+	db := newTestDB(t)
+	shared := newTestEnvelope(t, db, "rent", 0)
+	private := newTestEnvelope(t, db, "bob's", 0)
+	if err := db.UpdateEnvelopeMeta(private, func(e *Envelope) { e.Owner = "bob" }); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateEnvelopeBalance(shared, 100, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateEnvelopeBalance(private, 500, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	for user, want := range map[string]int{"alice": 100, "bob": 600, "": 600} {
+		totals, err := db.BalanceTimeSeries(today, today, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(totals) != 1 || totals[0].Balance != want {
+			t.Errorf(`totals for %q are %+v, want %d`, user, totals, want)
+		}
+	}
+}
+
+func TestSpreadFrom(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestEnvelope(t, db, "a", 0)
+	b := newTestEnvelope(t, db, "b", 0)
+	x := newTestEnvelope(t, db, "x", 100)
+
+	if err := db.UpdateEnvelopeBalance(a, 300, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateEnvelopeBalance(b, 100, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only 100 is needed, and the sources give in proportion to their balance
+	if err := db.SpreadFrom([]uuid.UUID{a, b, a}, SpreadRemaining, ""); err != nil {
+		t.Fatal(err)
+	}
+	got := [3]int{mustEnvelope(t, db, a).Balance, mustEnvelope(t, db, b).Balance, mustEnvelope(t, db, x).Balance}
+	if want := [3]int{225, 75, 100}; got != want {
+		t.Errorf(`balances are %v, want %v`, got, want)
+	}
+
+	// Everything is handed out, so the sources end up empty
+	if err := db.SpreadFrom([]uuid.UUID{a, b}, SpreadEven, ""); err != nil {
+		t.Fatal(err)
+	}
+	got = [3]int{mustEnvelope(t, db, a).Balance, mustEnvelope(t, db, b).Balance, mustEnvelope(t, db, x).Balance}
+	if want := [3]int{0, 0, 400}; got != want {
+		t.Errorf(`balances are %v, want %v`, got, want)
+	}
+}
+
+func TestTransferTarget(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestEnvelope(t, db, "a", 300)
+	b := newTestEnvelope(t, db, "b", 100)
+	if err := db.UpdateEnvelopeBalance(a, 500, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.TransferTarget(a, b, 400); !errors.Is(err, errInvalidValue) {
+		t.Errorf(`moving more than the target: got %v, want errInvalidValue`, err)
+	}
+	if err := db.TransferTarget(a, b, 120); err != nil {
+		t.Fatal(err)
+	}
+
+	ea, eb := mustEnvelope(t, db, a), mustEnvelope(t, db, b)
+	if ea.MonthTarget != 180 || eb.MonthTarget != 220 {
+		t.Errorf(`monthly targets are %d and %d, want 180 and 220`, ea.MonthTarget, eb.MonthTarget)
+	}
+	if ea.Balance != 500 || eb.Balance != 0 {
+		t.Errorf(`balances changed to %d and %d`, ea.Balance, eb.Balance)
+	}
+}
+
+func TestMergeEventConcurrentNewEnvelope(t *testing.T) {
+	// A file, so there is more than one connection
+	db, err := OpenDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	id := uuid.New()
+	errs := make(chan error)
+	for range 10 {
+		go func() {
+			errs <- db.MergeEvent(Event{Id: uuid.New(), EnvelopeId: id, Balance: 100, Kind: KindExternal})
+		}()
+	}
+	for range 10 {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	if e := mustEnvelope(t, db, id); e.Balance != 1000 {
+		t.Errorf(`balance is %d, want 1000`, e.Balance)
+	}
+}
+
+func TestUpdateEnvelopeBalanceConcurrent(t *testing.T) {
+	db, err := OpenDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	id := newTestEnvelope(t, db, "food", 0)
+
+	errs := make(chan error)
+	for i := 0; i < 50; i++ {
+		go func() {
+			errs <- db.UpdateEnvelopeBalance(id, 10, "")
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		// Writers wait for each other instead of failing with "database is
+		// locked"
+		if err := <-errs; err != nil {
+			t.Errorf(`concurrent update: %s`, err)
+		}
+	}
+	if e := mustEnvelope(t, db, id); e.Balance != 500 {
+		t.Errorf(`balance is %d, want 500`, e.Balance)
+	}
+}
+
+func TestPersistLostDB(t *testing.T) {
+	t.Setenv("ENVELOPES_DB_KEY", "secret")
+	dir := t.TempDir()
+	db, err := OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := newTestEnvelope(t, db, "food", 0)
+
+	// A fresh in-memory DB has no tables, which looks the same as this
+	for _, table := range []string{"history", "conflicts", "envelopes"} {
+		if _, err := db.db.Exec(`DROP TABLE ` + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.persist(); !errors.Is(err, errLostDB) {
+		t.Errorf(`persisting a lost DB: got %v, want errLostDB`, err)
+	}
+	db.Close()
+
+	db, err = OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mustEnvelope(t, db, id)
+}
+
+func TestPersistConcurrent(t *testing.T) {
+	t.Setenv("ENVELOPES_DB_KEY", "secret")
+	dir := t.TempDir()
+	db, err := OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := newTestEnvelope(t, db, "food", 0)
+
+	errs := make(chan error)
+	for range 20 {
+		go func() {
+			errs <- db.UpdateEnvelopeBalance(id, 10, "")
+		}()
+	}
+	for range 20 {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Whatever was written last has to have all of the changes
+	db, err = OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if e := mustEnvelope(t, db, id); e.Balance != 200 {
+		t.Errorf(`balance is %d after reopening, want 200`, e.Balance)
+	}
+}
+
+func TestCreateEnvelopes(t *testing.T) {
+	db := newTestDB(t)
+
+	// One invalid envelope keeps all of them from being created
+	_, err := db.CreateEnvelopes([]func(e *Envelope){
+		func(e *Envelope) { e.Name = "rent" },
+		func(e *Envelope) { e.GoalDate = "someday" },
+	})
+	if !errors.Is(err, errInvalidValue) {
+		t.Fatalf(`got %v, want errInvalidValue`, err)
+	}
+	if envelopes := db.AllEnvelopes(); len(envelopes) != 0 {
+		t.Fatalf(`got %d envelopes, want none`, len(envelopes))
+	}
+
+	ids, err := db.ApplyPreset(defaultPresets["basic"], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(defaultPresets["basic"]) {
+		t.Errorf(`created %d envelopes, want %d`, len(ids), len(defaultPresets["basic"]))
+	}
+	if e := mustEnvelope(t, db, ids[0]); e.Name != "Rent" || e.MonthTarget != 80000 {
+		t.Errorf(`got %q with monthly target %d`, e.Name, e.MonthTarget)
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	db := newTestDB(t)
+	id := newTestEnvelope(t, db, "food", 100)
+	env := mustEnvelope(t, db, id)
+
+	// Made elsewhere before the envelope was last changed here, so it loses
+	lost := Event{
+		Id: uuid.New(), EnvelopeId: id, Meta: true, Name: "groceries", Origin: "elsewhere",
+		MonthTarget: 50, PrevMonthTarget: 100, Currency: env.Currency,
+		Date: time.Now().Add(-time.Hour).UTC().Format(dateFormat),
+	}
+	if err := db.MergeEvent(lost); err != nil {
+		t.Fatal(err)
+	}
+	if e := mustEnvelope(t, db, id); e.Name != "food" {
+		t.Fatalf(`older change won, name is %q`, e.Name)
+	}
+
+	conflicts, err := db.Conflicts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || conflicts[0].Event.Id != lost.Id || len(conflicts[0].Fields) != 2 {
+		t.Fatalf(`got conflicts %+v`, conflicts)
+	}
+
+	if err := db.ResolveConflict(lost.Id, true); err != nil {
+		t.Fatal(err)
+	}
+	if e := mustEnvelope(t, db, id); e.Name != "groceries" || e.MonthTarget != 150 {
+		t.Errorf(`got %q with monthly target %d after restoring, want "groceries" and 150`, e.Name, e.MonthTarget)
+	}
+	if conflicts, err := db.Conflicts(); err != nil || len(conflicts) != 0 {
+		t.Errorf(`got %v and %d conflicts after resolving`, err, len(conflicts))
+	}
+	if err := db.ResolveConflict(lost.Id, false); !errors.Is(err, errNotFound) {
+		t.Errorf(`resolving twice: got %v, want errNotFound`, err)
+	}
+}
+
+func TestPruneHistory(t *testing.T) {
+	db := newTestDB(t)
+	id := uuid.New()
+	ago := func(days int) string {
+		return time.Now().AddDate(0, 0, -days).UTC().Format(dateFormat)
+	}
+
+	original := []Event{
+		{Id: uuid.New(), EnvelopeId: id, Meta: true, Name: "food", MonthTarget: 100, Date: ago(90)},
+		{Id: uuid.New(), EnvelopeId: id, Balance: 1000, Kind: KindExternal, Date: ago(80)},
+		{Id: uuid.New(), EnvelopeId: id, Balance: -300, Kind: KindExternal, Date: ago(70)},
+		// Lost against the rename below
+		{Id: uuid.New(), EnvelopeId: id, Meta: true, Name: "snacks", Origin: "elsewhere", PrevMonthTarget: 100, Date: ago(60)},
+		{Id: uuid.New(), EnvelopeId: id, Balance: -50, Kind: KindExternal, Date: ago(10)},
+		{Id: uuid.New(), EnvelopeId: id, Meta: true, Name: "groceries", PrevMonthTarget: 100, MonthTarget: 20, Date: ago(5)},
+	}
+	// The rename is merged before the change it wins against
+	order := []int{0, 1, 2, 5, 3, 4}
+	for _, i := range order {
+		if err := db.MergeEvent(original[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := mustEnvelope(t, db, id)
+
+	if err := db.PruneHistory(time.Now().AddDate(0, 0, -30)); err != nil {
+		t.Fatal(err)
+	}
+	after := mustEnvelope(t, db, id)
+	if after.Balance != 650 || after.Balance != before.Balance || !after.sameMeta(before) {
+		t.Fatalf(`got %+v after pruning, want %+v`, after, before)
+	}
+	if found, err := db.VerifyIntegrity(); err != nil || len(found) != 0 {
+		t.Fatalf(`got %v and discrepancies %+v`, err, found)
+	}
+	if conflicts, err := db.Conflicts(); err != nil || len(conflicts) != 0 {
+		t.Errorf(`got %v and conflicts %+v about pruned events`, err, conflicts)
+	}
+
+	events, err := db.ExportEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[0].Kind != KindOpening || events[0].Balance != 700 || !events[0].Meta {
+		t.Fatalf(`got history %+v, want an opening event and the two newer events`, events)
+	}
+
+	// Pruning again changes nothing
+	if err := db.PruneHistory(time.Now().AddDate(0, 0, -30)); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := db.ExportEvents(); err != nil || len(again) != len(events) {
+		t.Fatalf(`got %v and %d events after pruning again`, err, len(again))
+	}
+
+	// Instances that still have the pruned events don't bring them back
+	if n, err := db.Restore(original); err != nil || n != 0 {
+		t.Fatalf(`restored %d events with %v, want none`, n, err)
+	}
+	if e := mustEnvelope(t, db, id); e.Balance != 650 {
+		t.Fatalf(`got balance %d after restoring the pruned events`, e.Balance)
+	}
+
+	// An instance that gets both ends up at the same balance, in either order
+	for _, batches := range [][][]Event{{events, original}, {original, events}} {
+		other := newTestDB(t)
+		for _, batch := range batches {
+			if _, err := other.Restore(batch); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if e := mustEnvelope(t, other, id); e.Balance != 650 || e.Name != "groceries" || e.MonthTarget != 120 {
+			t.Errorf(`got %q with balance %d and monthly target %d, want "groceries", 650 and 120`, e.Name, e.Balance, e.MonthTarget)
+		}
+	}
+}
+
+func TestUndoAfterRestart(t *testing.T) {
+	defer func(w time.Duration) { undoWindow = w }(undoWindow)
+	undoWindow = time.Hour
+
+	dir := t.TempDir()
+	db, err := OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := newTestEnvelope(t, db, "food", 0)
+	if err := db.UpdateEnvelopeBalance(id, 1000, "salary"); err != nil {
+		t.Fatal(err)
+	}
+	_, history, err := db.EnvelopeWithHistory(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salary := history[len(history)-1]
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The change is still pending after reopening, so it isn't exported
+	// and can be undone
+	db, err = OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.Pending(salary.Id) {
+		t.Errorf(`%s isn't pending after reopening`, salary.Id)
+	}
+	events, err := db.ExportEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf(`exported %d events, want only the envelope`, len(events))
+	}
+	if err := db.Undo(salary.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the window is over while the DB is closed, the change is final
+	// when it is opened again
+	db, err = OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	undoWindow = time.Millisecond
+	if err := db.UpdateEnvelopeBalance(id, 50, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	db, err = OpenDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if events, err = db.ExportEvents(); err != nil || len(events) == 2 {
+			break
+		}
+	}
+	if len(events) != 2 {
+		t.Errorf(`exported %d events, want the envelope and the final change`, len(events))
+	}
+}
+
+func TestHistoryOrderIgnoresRowid(t *testing.T) {
+	db := newTestDB(t)
+	id := newTestEnvelope(t, db, "food", 0)
+	for _, amount := range []int{100, 200, 300} {
+		if err := db.UpdateEnvelopeBalance(id, amount, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := db.ExportEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// VACUUM may renumber rowids, here they end up in reverse
+	if _, err := db.db.Exec(`UPDATE history SET rowid = 1000 - rowid`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.db.Exec(`VACUUM`); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := db.ExportEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range before {
+		if i >= len(after) || after[i].Id != before[i].Id {
+			t.Fatalf(`history is %+v after renumbering, want %+v`, after, before)
+		}
+	}
+	if found, err := db.VerifyIntegrity(); err != nil || len(found) != 0 {
+		t.Errorf(`got %v and discrepancies %+v`, err, found)
+	}
+}
+
+func TestPruneKeepsPending(t *testing.T) {
+	defer func(w time.Duration) { undoWindow = w }(undoWindow)
+
+	db := newTestDB(t)
+	id := newTestEnvelope(t, db, "food", 0)
+	if err := db.UpdateEnvelopeBalance(id, 100, "final"); err != nil {
+		t.Fatal(err)
+	}
+	undoWindow = time.Hour
+	if err := db.UpdateEnvelopeBalance(id, 1000, "pending"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.PruneHistory(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	_, history, err := db.EnvelopeWithHistory(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	undone := false
+	for _, e := range history {
+		if e.Comment == "pending" {
+			if err := db.Undo(e.Id); err != nil {
+				t.Fatal(err)
+			}
+			undone = true
+		}
+	}
+	if !undone {
+		t.Fatal(`pruning removed the pending change`)
+	}
+	if e := mustEnvelope(t, db, id); e.Balance != 100 {
+		t.Errorf(`balance is %d, want 100`, e.Balance)
+	}
+	if found, err := db.VerifyIntegrity(); err != nil || len(found) != 0 {
+		t.Errorf(`got %v and discrepancies %+v`, err, found)
+	}
+}
+
+func TestReverseEvent(t *testing.T) {
+	db := newTestDB(t)
+	food := newTestEnvelope(t, db, "food", 0)
+	rent := newTestEnvelope(t, db, "rent", 0)
+	if err := db.UpdateEnvelopeBalance(food, 1000, "salary"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Transfer(food, rent, 300, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	_, history, err := db.EnvelopeWithHistory(food)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range history {
+		if e.Kind == KindTransfer {
+			if err := db.ReverseEvent(e.Id); !errors.Is(err, errInvalidValue) {
+				t.Errorf(`reversing one side of a transfer: got %v, want errInvalidValue`, err)
+			}
+			continue
+		}
+		if e.Comment != "salary" {
+			continue
+		}
+
+		// Only one of several concurrent reversals goes through
+		errs := make(chan error)
+		for i := 0; i < 10; i++ {
+			go func() {
+				errs <- db.ReverseEvent(e.Id)
+			}()
+		}
+		failed := 0
+		for i := 0; i < 10; i++ {
+			if err := <-errs; errors.Is(err, errInvalidValue) {
+				failed++
+			} else if err != nil {
+				t.Error(err)
+			}
+		}
+		if failed != 9 {
+			t.Errorf(`%d reversals failed, want 9`, failed)
+		}
+	}
+
+	if f := mustEnvelope(t, db, food); f.Balance != -300 {
+		t.Errorf(`balance is %d, want -300`, f.Balance)
+	}
+}
+
+func TestUndo(t *testing.T) {
+	defer func(w time.Duration) { undoWindow = w }(undoWindow)
+	undoWindow = time.Hour
+
+	db := newTestDB(t)
+	food := newTestEnvelope(t, db, "food", 0)
+	rent := newTestEnvelope(t, db, "rent", 0)
+	if err := db.UpdateEnvelopeBalance(food, 1000, "salary"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Transfer(food, rent, 300, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := db.ExportEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf(`exported %d events, want only the two envelopes`, len(events))
+	}
+
+	_, history, err := db.EnvelopeWithHistory(rent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer := history[len(history)-1]
+	if !db.Pending(transfer.Id) {
+		t.Fatalf(`transfer %s isn't pending`, transfer.Id)
+	}
+	if err := db.ReverseEvent(transfer.Id); !errors.Is(err, errInvalidValue) {
+		t.Errorf(`reversing a pending change: got %v, want errInvalidValue`, err)
+	}
+	// Undoing one side of the transfer undoes both
+	if err := db.Undo(transfer.Id); err != nil {
+		t.Fatal(err)
+	}
+	if f, r := mustEnvelope(t, db, food), mustEnvelope(t, db, rent); f.Balance != 1000 || r.Balance != 0 {
+		t.Errorf(`got balances %d and %d after undoing the transfer, want 1000 and 0`, f.Balance, r.Balance)
+	}
+	if err := db.Undo(transfer.Id); !errors.Is(err, errNotPending) {
+		t.Errorf(`undoing twice: got %v, want errNotPending`, err)
+	}
+	if found, err := db.VerifyIntegrity(); err != nil || len(found) != 0 {
+		t.Errorf(`got %v and discrepancies %+v`, err, found)
+	}
+
+	// Once the window is over, the change is final
+	undoWindow = time.Millisecond
+	if err := db.UpdateEnvelopeBalance(rent, 50, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, history, err = db.EnvelopeWithHistory(rent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := history[len(history)-1]
+	for deadline := time.Now().Add(time.Second); db.Pending(last.Id) && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if err := db.Undo(last.Id); !errors.Is(err, errNotPending) {
+		t.Errorf(`undoing a final change: got %v, want errNotPending`, err)
+	}
+	if e := mustEnvelope(t, db, rent); e.Balance != 50 {
+		t.Errorf(`got balance %d, want 50`, e.Balance)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+func handleDebug(db *DB, w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := db.db.Stats()
+
+	w.Header().Add("Content-Type", "text/plain")
+	w.Write([]byte("Hic sunt dracones\r\n\r\n"))
+	fmt.Fprintf(w, "goroutines: %d\r\n", runtime.NumGoroutine())
+	fmt.Fprintf(w, "heap in use: %d bytes\r\n", mem.HeapInuse)
+	fmt.Fprintf(w, "DB connections: %d open, %d in use\r\n", stats.OpenConnections, stats.InUse)
+	fmt.Fprintf(w, "DB waits: %d, %s total\r\n", stats.WaitCount, stats.WaitDuration)
+}
+
+// servePprof serves the pprof handlers on addr. They are kept off the main
+// listener, since they are neither behind the password nor meant for users.
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	log.Printf(`serving pprof on %s`, addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf(`pprof died: %s`, err)
+	}
+}
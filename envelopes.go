@@ -1,133 +1,392 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 var templFuncs = template.FuncMap{
-	"prettyDisplay": prettyDisplay,
-	"delta":         computeDelta,
+	"prettyDisplay":   prettyDisplay,
+	"formatDate":      formatDate,
+	"money":           money,
+	"delta":           computeDelta,
+	"presets":         presetNames,
+	"remaining":       computeRemaining,
+	"goalHint":        goalHint,
+	"currencies":      sortedCurrencies,
+	"defaultCurrency": func() string { return defaultCurrency },
+	"base":            func() string { return routePrefix },
+	"attachment":      attachmentLink,
 }
-var templ = template.Must(template.New("").Funcs(templFuncs).ParseGlob("templates/*.html"))
 
-func prettyDisplay(cents int) string {
-	return fmt.Sprintf("%.02f", float64(cents)/100)
+// routePrefix is prepended to all links and redirects, so the app can be
+// served from a subpath like /budget behind a reverse proxy.
+var routePrefix = ""
+
+func redirect(w http.ResponseWriter, r *http.Request, path string) {
+	http.Redirect(w, r, routePrefix+path, http.StatusSeeOther)
+}
+
+// formatDate renders a stored event date in local time, down to the minute.
+// Dates that can't be parsed are shown as they are.
+func formatDate(date string) string {
+	t, err := time.Parse(dateFormat, normalizeDate(date))
+	if err != nil {
+		return date
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func prettyDisplay(amount int, currency ...string) string {
+	if len(currency) == 0 {
+		return lookupCurrency(defaultCurrency).Decimal(amount)
+	}
+	return lookupCurrency(currency[0]).Decimal(amount)
+}
+
+func money(amount int, currency string) string {
+	return lookupCurrency(currency).Format(amount)
 }
 
-func computeDelta(balance, target int) []string {
+// deltaNearPercent is how far an envelope may miss its target, in percent of
+// the target, to be shown as nearly there instead of with a warning.
+var deltaNearPercent = 5
+
+// computeDelta returns the CSS class and text for how far balance is from
+// target. For liabilities, being above the target is what's bad.
+func computeDelta(balance, target int, currency string, liability bool) []string {
 	delta := balance - target
+	short := -delta
+	if liability {
+		short = delta
+	}
+	cls := "delta-ok"
+	if short > 0 {
+		cls = "delta-warn"
+		if short*100 <= abs(target)*deltaNearPercent {
+			cls = "delta-near"
+		}
+	}
+	return []string{cls, money(delta, currency)}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func computeRemaining(e *Envelope) []string {
 	cls := "delta-ok"
-	if delta < 0 {
+	if e.MonthRemaining() > 0 {
 		cls = "delta-warn"
 	}
-	return []string{cls, fmt.Sprintf(`%.02f`, float64(delta)/100)}
+	return []string{cls, money(e.MonthRemaining(), e.Currency)}
+}
+
+// goalHint describes what it takes to reach the savings goal of e, or returns
+// an empty string if e has no goal.
+func goalHint(e *Envelope) string {
+	if e.GoalAmount <= 0 || e.GoalDate == "" {
+		return ""
+	}
+	monthly := e.GoalMonthly(time.Now())
+	if monthly == 0 {
+		return fmt.Sprintf("Goal of %s reached", money(e.GoalAmount, e.Currency))
+	}
+	hint := fmt.Sprintf("Put %s per month into this envelope to have %s by %s",
+		money(monthly, e.Currency), money(e.GoalAmount, e.Currency), e.GoalDate)
+	if monthly > e.MonthTarget {
+		hint += fmt.Sprintf(", suggested monthly target: %s", prettyDisplay(monthly, e.Currency))
+	}
+	return hint
 }
 
 func handleDeleteRequest(db *DB, w http.ResponseWriter, r *http.Request) {
-	log.Printf(`delete: %v`, r.URL)
-	log.Printf(`id: %s`, r.FormValue("id"))
+	if r.Method != "POST" {
+		redirect(w, r, "/")
+		return
+	}
 
 	id, err := uuid.Parse(r.FormValue("id"))
 	if err != nil {
 		log.Printf(`update: can't parse ID: %s`, err)
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		redirect(w, r, "/")
+		return
+	}
+
+	if _, err := visibleEnvelope(db, id, requestUser(r)); errors.Is(err, errNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf(`delete: can't get envelope %s: %s`, id, err)
+		redirect(w, r, "/")
 		return
 	}
 
 	db.DeleteEnvelope(id)
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	redirect(w, r, "/")
 }
 
-func handleUpdateRequest(db *DB, w http.ResponseWriter, r *http.Request) {
-	log.Printf(`update: %v`, r.URL)
-
-	log.Printf(`name: %s`, r.FormValue("env-name"))
-	log.Printf(`target: %s`, r.FormValue("env-target"))
-	log.Printf(`monthtarget: %s`, r.FormValue("env-monthtarget"))
-	log.Printf(`return: %s`, r.FormValue("env-return"))
+// parseAmountField parses the amount in the form field name. An empty field is
+// zero.
+func parseAmountField(r *http.Request, cur Currency, name string) (int, error) {
+	value := r.FormValue(name)
+	if strings.TrimSpace(value) == "" {
+		return 0, nil
+	}
+	return cur.Parse(value)
+}
 
+func handleUpdateRequest(db *DB, w http.ResponseWriter, r *http.Request) {
 	returnTo := "/"
 	if r.FormValue("env-return") != "" {
 		returnTo = "/details?id=" + r.FormValue("env-return")
 	}
 
 	id, err := uuid.Parse(r.FormValue("env-id"))
-	if err != nil {
-		log.Printf(`update: can't parse ID: %s`, err)
-		id = uuid.New()
+	currency := defaultCurrency
+	if err == nil {
+		env, err := visibleEnvelope(db, id, requestUser(r))
+		if errors.Is(err, errNotFound) {
+			http.NotFound(w, r)
+			return
+		} else if err == nil {
+			currency = env.Currency
+		}
+	}
+	if c, ok := currencies[r.FormValue("env-currency")]; ok {
+		currency = c.Code
 	}
 
-	name := r.FormValue("env-name")
-
-	newTarget := 0
-	if tgt, err := strconv.ParseFloat(r.FormValue("env-target"), 64); err == nil {
-		newTarget = int(tgt * 100)
+	// Amounts are parsed before anything is changed, so a typo doesn't
+	// silently reset them
+	cur := lookupCurrency(currency)
+	amounts := map[string]int{}
+	for _, name := range []string{"env-target", "env-monthtarget", "env-monthcap", "env-goalamount"} {
+		amount, err := parseAmountField(r, cur, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		amounts[name] = amount
 	}
 
-	newMonthTarget := 0
-	if monthtgt, err := strconv.ParseFloat(r.FormValue("env-monthtarget"), 64); err == nil {
-		newMonthTarget = int(monthtgt * 100)
+	update := func(e *Envelope) {
+		e.Name = r.FormValue("env-name")
+		if c, ok := currencies[r.FormValue("env-currency")]; ok {
+			e.Currency = c.Code
+		}
+		e.Target = amounts["env-target"]
+		e.MonthTarget = amounts["env-monthtarget"]
+
+		// Only the details page has the goal fields and the checkboxes,
+		// other forms leave them alone
+		if _, ok := r.Form["env-goalamount"]; ok {
+			e.Liability = r.FormValue("env-liability") != ""
+			e.ExcludeFromTotals = r.FormValue("env-excludetotals") != ""
+			e.AutoSpread = r.FormValue("env-autospread")
+			e.MonthCap = amounts["env-monthcap"]
+			if user := requestUser(r); user != "" {
+				e.Owner = user
+				if r.FormValue("env-shared") != "" {
+					e.Owner = ""
+				}
+			}
+			e.GoalAmount = amounts["env-goalamount"]
+			e.GoalDate = strings.TrimSpace(r.FormValue("env-goaldate"))
+		}
 	}
 
-	if err = db.UpdateEnvelopeMeta(id, name, newTarget, newMonthTarget); err != nil {
+	id, err = uuid.Parse(r.FormValue("env-id"))
+	if err != nil {
+		log.Printf(`update: can't parse ID, creating new envelope: %s`, err)
+		id, err = db.CreateEnvelope(func(e *Envelope) {
+			// New envelopes belong to whoever creates them
+			e.Owner = requestUser(r)
+			update(e)
+		})
+	} else if version := r.FormValue("env-version"); version != "" {
+		// The form was loaded with this version, don't overwrite changes
+		// made since then
+		err = db.UpdateEnvelopeMetaVersion(id, version, update)
+	} else {
+		err = db.UpdateEnvelopeMeta(id, update)
+	}
+	if errors.Is(err, errInvalidValue) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, errStaleVersion) {
+		http.Error(w, "The envelope was changed in the meantime, reload the page and try again", http.StatusConflict)
+		return
+	} else if err != nil {
 		log.Printf(`can't update envelope %s: %s`, id, err)
-		http.Redirect(w, r, returnTo, http.StatusSeeOther)
+		redirect(w, r, returnTo)
 		return
 	}
 
-	http.Redirect(w, r, returnTo, http.StatusSeeOther)
+	redirect(w, r, returnTo)
 }
 
-func handleDebug(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "text/plain")
-	w.Write([]byte("Hic sunt dracones\r\n\r\n"))
+// envelopeDetails is what the detail page of an envelope shows.
+type envelopeDetails struct {
+	page
+	Envelope *Envelope `json:"envelope"`
+	// Newest first
+	Events []Event `json:"events"`
+	// Events that have been reversed
+	Reversed map[uuid.UUID]bool `json:"-"`
+	// Events that can still be undone
+	Pending map[uuid.UUID]bool `json:"-"`
+	Tag     string             `json:"tag,omitempty"`
+	// Envelopes this one can be merged into
+	Others []*Envelope `json:"-"`
+	// Who is looking at the envelope
+	User string `json:"-"`
+	// Whether the change that was just recorded went over the cap
+	CapWarning bool `json:"-"`
+}
+
+// gatherDetails collects the envelope with the given ID and its history, if
+// user sees it. If tag is set, only events with that tag are included.
+func gatherDetails(db *DB, id uuid.UUID, tag, user string) (*envelopeDetails, error) {
+	e, events, err := db.EnvelopeWithHistory(id)
+	if err != nil {
+		return nil, err
+	}
+	if !e.VisibleTo(user) {
+		return nil, fmt.Errorf(`%w: envelope %s`, errNotFound, id)
+	}
+
+	if e.MonthCap > 0 {
+		if e.MonthSpent, err = db.MonthSpent(id); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &envelopeDetails{
+		Envelope: e,
+		Events:   []Event{},
+		Reversed: map[uuid.UUID]bool{},
+		Pending:  map[uuid.UUID]bool{},
+		Tag:      tag,
+		Others:   []*Envelope{},
+		User:     user,
+	}
+	for idx := len(events) - 1; idx >= 0; idx-- {
+		d.Reversed[events[idx].Reverses] = true
+		if db.Pending(events[idx].Id) {
+			d.Pending[events[idx].Id] = true
+		}
+		if tag != "" && !events[idx].HasTag(tag) {
+			continue
+		}
+		d.Events = append(d.Events, events[idx])
+	}
+
+	for _, o := range visibleTo(db.AllEnvelopes(), user) {
+		if o.Id != e.Id && o.Currency == e.Currency {
+			d.Others = append(d.Others, o)
+		}
+	}
+
+	return d, nil
 }
 
 func handleDetail(db *DB, w http.ResponseWriter, r *http.Request) {
-	log.Printf(`handling detail for id %s`, r.FormValue("id"))
 	id, err := uuid.Parse(r.FormValue("id"))
 	if err != nil {
 		log.Printf(`detail: can't parse ID: %s`, err)
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		if wantsJSON(r) {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		redirect(w, r, "/")
 		return
 	}
 
-	e, events, err := db.EnvelopeWithHistory(id)
-	if err != nil {
+	d, err := gatherDetails(db, id, r.FormValue("tag"), requestUser(r))
+	if errors.Is(err, errNotFound) {
+		renderError(w, r, http.StatusNotFound, errors.New("no such envelope"))
+		return
+	} else if err != nil {
 		log.Printf(`detail: can't get envelope and history from DB: %s`, err)
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		if wantsJSON(r) {
+			writeJSONError(w, http.StatusInternalServerError, errors.New("can't get envelope"))
+			return
+		}
+		redirect(w, r, "/")
 		return
 	}
 
-	events_rev := []Event{}
-	for idx := len(events) - 1; idx >= 0; idx-- {
-		events_rev = append(events_rev, events[idx])
+	d.CapWarning = r.FormValue("overcap") != "" && d.Envelope.OverCap()
+	d.page = pageFor(r)
+	render(w, r, "details.html", d)
+}
+
+func handleReverse(db *DB, w http.ResponseWriter, r *http.Request) {
+	returnTo := "/"
+	if r.FormValue("envelope") != "" {
+		returnTo = "/details?id=" + r.FormValue("envelope")
 	}
 
-	param := struct {
-		Envelope *Envelope
-		Events   []Event
-	}{e, events_rev}
+	if r.Method != "POST" {
+		redirect(w, r, returnTo)
+		return
+	}
 
-	if err := templ.ExecuteTemplate(w, "details.html", param); err != nil {
-		log.Printf(`error rendering details template: %s`, err)
+	id, err := uuid.Parse(r.FormValue("id"))
+	if err != nil {
+		log.Printf(`reverse: can't parse ID: %s`, err)
+		redirect(w, r, returnTo)
+		return
 	}
+
+	if _, err := visibleEvent(db, id, requestUser(r)); errors.Is(err, errNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := db.ReverseEvent(id); err != nil {
+		status := errorStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Printf(`can't reverse event %s: %s`, id, err)
+			err = errors.New("can't reverse event")
+		}
+		renderError(w, r, status, err)
+		return
+	}
+
+	redirect(w, r, returnTo)
 }
 
 func handleTx(db *DB, w http.ResponseWriter, r *http.Request) {
-	log.Printf(`tx for id %s`, r.FormValue(`id`))
+	if r.Method == "POST" {
+		// Leaves room for the other fields next to the receipt
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1<<20)
+		if err := r.ParseMultipartForm(1 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
 	id, err := uuid.Parse(r.FormValue("id"))
 	if err != nil {
 		log.Printf(`tx: can't parse ID: %s`, err)
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		redirect(w, r, "/")
 		return
 	}
 
@@ -144,9 +403,12 @@ func handleTx(db *DB, w http.ResponseWriter, r *http.Request) {
 	}
 
 	env, err := db.Envelope(id)
-	if err != nil {
+	if errors.Is(err, errNotFound) || (err == nil && !env.VisibleTo(requestUser(r))) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
 		log.Printf(`tx: can't get envelope %s: %s`, r.FormValue(`id`), err)
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		redirect(w, r, "/")
 		return
 	}
 
@@ -155,164 +417,845 @@ func handleTx(db *DB, w http.ResponseWriter, r *http.Request) {
 		case `in`:
 			fallthrough
 		case `out`:
-			log.Printf(`tx %s`, dir)
+			if env.MonthCap > 0 {
+				if env.MonthSpent, err = db.MonthSpent(env.Id); err != nil {
+					log.Printf(`tx: can't get spending of %s: %s`, env.Id, err)
+				}
+			}
 			params := struct {
 				Envelope  *Envelope
 				Direction string
+				Token     string
 			}{
 				Envelope:  env,
 				Direction: dir,
+				Token:     uuid.NewString(),
 			}
-			if err := templ.ExecuteTemplate(w, "transfer_in.html", params); err != nil {
+			if err := executeTemplate(w, "transfer_in.html", params); err != nil {
 				log.Printf(`error rendering details template: %s`, err)
 			}
 		default:
 			params := struct {
 				AllEnvelopes []*Envelope
 				This         *Envelope
+				Token        string
 			}{
 				AllEnvelopes: []*Envelope{},
 				This:         env,
+				Token:        uuid.NewString(),
 			}
-			for _, e := range db.AllEnvelopes() {
-				if e.Id != env.Id {
+			for _, e := range visibleTo(db.AllEnvelopes(), requestUser(r)) {
+				if e.Id != env.Id && e.Currency == env.Currency {
 					params.AllEnvelopes = append(params.AllEnvelopes, e)
 				}
 			}
-			if err := templ.ExecuteTemplate(w, "transfer.html", params); err != nil {
+			if err := executeTemplate(w, "transfer.html", params); err != nil {
 				log.Printf(`error rendering details template: %s`, err)
 			}
-			log.Printf(`tx inout`)
 		}
 	} else {
-		log.Printf(`updating env %s`, r.FormValue(`id`))
-		log.Printf(`  amount: %s`, r.FormValue(`amount`))
-		amount, err := strconv.ParseFloat(r.FormValue(`amount`), 64)
-		if err != nil {
-			log.Printf(`can't parse %s: %s`, r.FormValue(`amount`), err)
-			http.Redirect(w, r, "/", http.StatusSeeOther)
-			return
+		t := txRequest{
+			EnvelopeId: id,
+			Direction:  dir,
+			Comment:    r.FormValue(`comment`),
+			Tags:       parseTags(r.FormValue(`tags`)),
 		}
-		switch dir {
-		case `in`:
-			if err = db.UpdateEnvelopeBalance(id, int(amount*100), r.FormValue(`comment`)); err != nil {
-				log.Printf(`can't update balance: %s`, err)
-			}
-		case `out`:
-			if err = db.UpdateEnvelopeBalance(id, -int(amount*100), r.FormValue(`comment`)); err != nil {
-				log.Printf(`can't update balance: %s`, err)
+		if dir == `inout` && r.FormValue(`closeout`) != "" {
+			// Close out: move everything that's left
+			t.Amount = env.Balance
+		} else {
+			amount, err := lookupCurrency(env.Currency).Parse(r.FormValue(`amount`))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
-		default:
+			t.Amount = amount
+		}
+		returnTo := fmt.Sprintf("/details?id=%s", id)
+		if dir == `inout` {
 			destId, err := uuid.Parse(r.FormValue("destination"))
 			if err != nil {
 				log.Printf(`tx: can't parse ID: %s`, err)
-				http.Redirect(w, r, "/", http.StatusSeeOther)
+				redirect(w, r, "/")
 				return
 			}
+			t.DestinationId = &destId
+			returnTo = fmt.Sprintf("/details?id=%s", destId)
+		}
 
-			dest, err := db.Envelope(destId)
-			if err != nil {
-				log.Printf(`can't get destination %s: %s`, destId, err)
-				http.Redirect(w, r, "/", http.StatusSeeOther)
+		// Every rendered form has its own token, so a form that is sent
+		// twice, e.g. by reloading the page, is only applied once
+		token := r.FormValue("token")
+		if !txTokens.claim(token) {
+			log.Printf(`tx: form with token %s was already submitted, ignoring it`, token)
+			redirect(w, r, returnTo)
+			return
+		}
+
+		// An uploaded receipt takes precedence over a link to one
+		upload := ""
+		if dir != `inout` {
+			if upload, err = saveUpload(r, "receipt"); err != nil {
+				txTokens.release(token)
+				log.Printf(`tx: can't store receipt: %s`, err)
+				http.Error(w, "can't store receipt", http.StatusInternalServerError)
 				return
 			}
-			src, err := db.Envelope(id)
-			if err != nil {
-				log.Printf(`can't get source %s: %s`, destId, err)
-				http.Redirect(w, r, "/", http.StatusSeeOther)
-				return
+			t.Attachment = r.FormValue("receipt-url")
+			if upload != "" {
+				t.Attachment = upload
 			}
+		}
+
+		envelopes, err := applyTx(db, t, requestUser(r))
+		if err != nil && upload != "" {
+			os.Remove(filepath.Join(uploadsDir, upload))
+		}
+		if errors.Is(err, errNotFound) {
+			txTokens.release(token)
+			http.NotFound(w, r)
+			return
+		} else if errors.Is(err, errInvalidValue) || errors.Is(err, errInvalidTx) {
+			txTokens.release(token)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			txTokens.release(token)
+			log.Printf(`can't apply transaction: %s`, err)
+		} else if dir == `out` && len(capWarnings(envelopes)) > 0 {
+			// Tell the details page to warn that this change went over
+			// the cap
+			returnTo += "&overcap=1"
+		}
+		redirect(w, r, returnTo)
+	}
+}
 
-			srccmmt := fmt.Sprintf("From %s", src.Name)
-			destcmmt := fmt.Sprintf(`To %s`, dest.Name)
-			if r.FormValue(`comment`) != "" {
-				cmmt := fmt.Sprintf(": %s", r.FormValue(`comment`))
-				srccmmt += cmmt
-				destcmmt += cmmt
+// txRequest is a transaction as submitted through the web form or the API.
+// Amount is in minor units of the envelope's currency and always positive,
+// Direction says where the money goes.
+type txRequest struct {
+	EnvelopeId    uuid.UUID  `json:"envelope_id"`
+	Amount        int        `json:"amount_cents"`
+	Direction     string     `json:"direction"`
+	Comment       string     `json:"comment"`
+	DestinationId *uuid.UUID `json:"destination_id,omitempty"`
+	Tags          []string   `json:"tags,omitempty"`
+	// Receipt of money going in or out, see attachmentRef
+	Attachment string `json:"attachment,omitempty"`
+}
+
+var errInvalidTx = errors.New("invalid transaction")
+
+// Limits for the amount of a single transaction, in minor units of the
+// currency of the envelope. Zero means there is no limit.
+var (
+	minTxAmount = 0
+	maxTxAmount = 0
+)
+
+// applyTx validates and records t for user, who has to see the envelopes
+// involved. It returns the changed envelopes with their new balances.
+// Validation errors wrap errInvalidTx.
+func applyTx(db *DB, t txRequest, user string) ([]*Envelope, error) {
+	if t.Amount <= 0 {
+		return nil, fmt.Errorf(`%w: amount must be positive`, errInvalidTx)
+	}
+
+	src, err := visibleEnvelope(db, t.EnvelopeId, user)
+	if err != nil {
+		return nil, err
+	}
+	cur := lookupCurrency(src.Currency)
+	if minTxAmount > 0 && t.Amount < minTxAmount {
+		return nil, fmt.Errorf(`%w: amount must be at least %s`, errInvalidTx, cur.Format(minTxAmount))
+	}
+	if maxTxAmount > 0 && t.Amount > maxTxAmount {
+		return nil, fmt.Errorf(`%w: amount must be at most %s`, errInvalidTx, cur.Format(maxTxAmount))
+	}
+
+	ids := []uuid.UUID{src.Id}
+	switch t.Direction {
+	case `in`:
+		err = db.UpdateEnvelopeBalanceAttached(src.Id, t.Amount, t.Comment, t.Attachment, t.Tags...)
+	case `out`:
+		err = db.UpdateEnvelopeBalanceAttached(src.Id, -t.Amount, t.Comment, t.Attachment, t.Tags...)
+	case `inout`:
+		if t.Attachment != "" {
+			return nil, fmt.Errorf(`%w: only money going in or out can have an attachment`, errInvalidTx)
+		}
+		if t.DestinationId == nil {
+			return nil, fmt.Errorf(`%w: missing destination`, errInvalidTx)
+		}
+		dest, err := visibleEnvelope(db, *t.DestinationId, user)
+		if err != nil {
+			return nil, err
+		}
+		if dest.Id == src.Id {
+			return nil, fmt.Errorf(`%w: source and destination are the same`, errInvalidTx)
+		}
+		if src.Currency != dest.Currency {
+			return nil, fmt.Errorf(`%w: can't transfer from %s to %s`, errInvalidTx, src.Currency, dest.Currency)
+		}
+
+		if err := db.Transfer(src.Id, dest.Id, t.Amount, t.Comment, t.Tags...); err != nil {
+			return nil, err
+		}
+		ids = append(ids, dest.Id)
+	default:
+		return nil, fmt.Errorf(`%w: unknown direction %q`, errInvalidTx, t.Direction)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []*Envelope{}
+	for _, id := range ids {
+		e, err := db.Envelope(id)
+		if err != nil {
+			return nil, err
+		}
+		if e.MonthSpent, err = db.MonthSpent(id); err != nil {
+			return nil, err
+		}
+		rv = append(rv, e)
+	}
+
+	return rv, nil
+}
+
+// capWarnings returns a warning for each of envelopes that is over its
+// monthly cap.
+func capWarnings(envelopes []*Envelope) []string {
+	warnings := []string{}
+	for _, e := range envelopes {
+		if e.OverCap() {
+			warnings = append(warnings, fmt.Sprintf(`%s: spent %s this month, the cap is %s`,
+				e.Name, money(e.MonthSpent, e.Currency), money(e.MonthCap, e.Currency)))
+		}
+	}
+	return warnings
+}
+
+func handleSpread(db *DB, w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(r.FormValue("id"))
+	if err != nil {
+		log.Printf(`spread: can't parse ID: %s`, err)
+		redirect(w, r, "/")
+		return
+	}
+
+	mode := r.FormValue("mode")
+	switch mode {
+	case "":
+		mode = SpreadProportional
+	case SpreadProportional, SpreadEven, SpreadRemaining:
+		/* nothing */
+	default:
+		http.Error(w, "unknown spread mode", http.StatusBadRequest)
+		return
+	}
+
+	// Balances of other envelopes selected with from are pooled with the
+	// one of the envelope given by id
+	ids := []uuid.UUID{id}
+	for _, from := range r.Form["from"] {
+		other, err := uuid.Parse(from)
+		if err != nil {
+			http.Error(w, "invalid envelope to spread from", http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, other)
+	}
+
+	user := requestUser(r)
+	sources := []*Envelope{}
+	isSource := map[uuid.UUID]bool{}
+	for _, id := range ids {
+		env, err := db.Envelope(id)
+		if errors.Is(err, errNotFound) || (err == nil && !env.VisibleTo(user)) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			log.Printf(`spread: can't get envelope %s: %s`, id, err)
+			redirect(w, r, "/")
+			return
+		}
+		if !isSource[id] {
+			sources = append(sources, env)
+		}
+		isSource[id] = true
+	}
+
+	if r.Method != "POST" {
+		plan, err := db.SpreadPlanFrom(ids, mode, user)
+		if errors.Is(err, errInvalidValue) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf(`spread: can't compute plan for %s: %s`, id, err)
+			redirect(w, r, "/")
+			return
+		}
+
+		pool := 0
+		for _, e := range sources {
+			pool += e.Balance
+		}
+		// What is left in the sources after the spread
+		kept := pool
+		for _, a := range plan {
+			kept -= a.Amount
+		}
+		others := []*Envelope{}
+		for _, e := range visibleTo(db.AllEnvelopes(), user) {
+			if e.Id != id && e.Currency == sources[0].Currency {
+				others = append(others, e)
 			}
+		}
+
+		params := struct {
+			Envelope    *Envelope
+			Sources     []*Envelope
+			IsSource    map[uuid.UUID]bool
+			Others      []*Envelope
+			Pool        int
+			Kept        int
+			Allocations []SpreadAllocation
+			Mode        string
+		}{sources[0], sources, isSource, others, pool, kept, plan, mode}
+		if err := executeTemplate(w, "spread.html", params); err != nil {
+			log.Printf(`error rendering spread template: %s`, err)
+		}
+		return
+	}
+
+	if err := db.SpreadFrom(ids, mode, user); errors.Is(err, errNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if errors.Is(err, errInvalidValue) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf(`something went wrong with the spread: %s`, err)
+		redirect(w, r, "/")
+		return
+	}
+
+	redirect(w, r, "/")
+}
+
+func handlePlan(db *DB, w http.ResponseWriter, r *http.Request) {
+	es := visibleTo(db.AllEnvelopes(), requestUser(r))
+
+	if r.Method != "POST" {
+		if err := executeTemplate(w, "plan.html", es); err != nil {
+			log.Printf(`error rendering plan template: %s`, err)
+		}
+		return
+	}
 
-			if err = db.UpdateEnvelopeBalance(destId, int(amount*100), srccmmt); err != nil {
-				log.Printf(`can't update balance: %s`, err)
-			} else if err = db.UpdateEnvelopeBalance(id, -int(amount*100), destcmmt); err != nil {
-				log.Printf(`can't update balance: %s`, err)
+	// Only envelopes that are in the form are changed, and only the values
+	// that are given
+	updates := map[uuid.UUID]func(e *Envelope){}
+	for _, e := range es {
+		cur := lookupCurrency(e.Currency)
+		parse := func(field string) (*int, error) {
+			v := r.FormValue(field + "-" + e.Id.String())
+			if v == "" {
+				return nil, nil
 			}
-			http.Redirect(w, r, fmt.Sprintf("/details?id=%s", destId), http.StatusSeeOther)
+			amount, err := cur.Parse(v)
+			if err != nil {
+				return nil, fmt.Errorf(`invalid %s for %s: %w`, field, e.Name, err)
+			}
+			return &amount, nil
+		}
+
+		target, err := parse("target")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		monthtarget, err := parse("monthtarget")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		http.Redirect(w, r, fmt.Sprintf("/details?id=%s", r.FormValue(`id`)), http.StatusSeeOther)
+		if target == nil && monthtarget == nil {
+			continue
+		}
+
+		updates[e.Id] = func(e *Envelope) {
+			if target != nil {
+				e.Target = *target
+			}
+			if monthtarget != nil {
+				e.MonthTarget = *monthtarget
+			}
+		}
+	}
+
+	if err := db.UpdateEnvelopesMeta(updates); errors.Is(err, errInvalidValue) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
+	} else if err != nil {
+		log.Printf(`plan: can't update envelopes: %s`, err)
 	}
+
+	redirect(w, r, "/")
 }
 
-func handleSpread(db *DB, w http.ResponseWriter, r *http.Request) {
-	log.Printf(`handling spread for id %s`, r.FormValue("id"))
+func handleTags(db *DB, w http.ResponseWriter, r *http.Request) {
+	tag := r.FormValue("tag")
+
+	events, err := db.EventsByTag(tag)
+	if err != nil {
+		log.Printf(`tags: can't get events: %s`, err)
+		redirect(w, r, "/")
+		return
+	}
+
+	events = visibleEvents(db, events, requestUser(r))
+
+	// Sums per currency, since envelopes may have different ones
+	totals := map[string]int{}
+	for _, e := range events {
+		totals[lookupCurrency(e.Currency).Code] += e.Balance
+	}
+
+	param := struct {
+		Tag    string
+		Events []Event
+		Totals map[string]int
+	}{tag, events, totals}
+
+	if err := executeTemplate(w, "tags.html", param); err != nil {
+		log.Printf(`error rendering tags template: %s`, err)
+	}
+}
+
+func handleArchive(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		redirect(w, r, "/")
+		return
+	}
 
 	id, err := uuid.Parse(r.FormValue("id"))
 	if err != nil {
-		log.Printf(`spread: can't parse ID: %s`, err)
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		log.Printf(`archive: can't parse ID: %s`, err)
+		redirect(w, r, "/")
 		return
 	}
 
-	if err := db.Spread(id); err != nil {
-		log.Printf(`something went wrong with the spread`, err)
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+	if _, err := visibleEnvelope(db, id, requestUser(r)); errors.Is(err, errNotFound) {
+		http.NotFound(w, r)
 		return
 	}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	if r.FormValue("archived") == "false" {
+		err = db.UnarchiveEnvelope(id)
+	} else {
+		err = db.ArchiveEnvelope(id)
+	}
+	if err != nil {
+		log.Printf(`can't change archive status of %s: %s`, id, err)
+	}
+
+	redirect(w, r, "/details?id="+id.String())
 }
 
-func handleRequest(db *DB, w http.ResponseWriter, r *http.Request) {
-	if r.URL.String() != "/" {
-		log.Printf(`ignoring request for %s`, r.URL)
+func handleReorder(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		if err := executeTemplate(w, "reorder.html", visibleTo(db.AllEnvelopes(), requestUser(r))); err != nil {
+			log.Printf(`error rendering reorder template: %s`, err)
+		}
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ids := []uuid.UUID{}
+	for _, v := range r.PostForm["id"] {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := visibleEnvelope(db, id, requestUser(r)); errors.Is(err, errNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	if err := db.ReorderEnvelopes(ids); err != nil {
+		log.Printf(`can't reorder envelopes: %s`, err)
+	}
+
+	redirect(w, r, "/")
+}
+
+func handleMerge(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		redirect(w, r, "/")
+		return
+	}
+
+	src, err := uuid.Parse(r.FormValue("id"))
+	if err != nil {
+		log.Printf(`merge: can't parse ID: %s`, err)
+		redirect(w, r, "/")
+		return
+	}
+	dst, err := uuid.Parse(r.FormValue("destination"))
+	if err != nil {
+		log.Printf(`merge: can't parse destination ID: %s`, err)
+		redirect(w, r, "/details?id="+src.String())
+		return
+	}
+
+	user := requestUser(r)
+	if _, err = visibleEnvelope(db, src, user); err == nil {
+		_, err = visibleEnvelope(db, dst, user)
+	}
+	if err == nil {
+		err = db.MergeEnvelopes(src, dst)
+	}
+	if errors.Is(err, errNotFound) {
 		http.NotFound(w, r)
 		return
+	} else if errors.Is(err, errInvalidValue) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf(`can't merge envelope %s into %s: %s`, src, dst, err)
+		redirect(w, r, "/details?id="+src.String())
+		return
 	}
 
-	log.Printf(`request: %v`, r.URL)
+	redirect(w, r, "/details?id="+dst.String())
+}
 
-	w.Header().Add("Content-Type", "text/html")
-	es := db.AllEnvelopes()
-	delta := int(0)
-	balance := int(0)
-	monthtarget := int(0)
-	for i := range es {
-		delta += es[i].Balance - es[i].Target
-		balance += es[i].Balance
-		monthtarget += es[i].MonthTarget
+// handleMoveTarget moves part of the monthly target of an envelope to
+// another one.
+func handleMoveTarget(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		redirect(w, r, "/")
+		return
 	}
-	dcls := "delta-ok"
-	if delta < 0 {
-		dcls = "delta-warn"
+
+	src, err := uuid.Parse(r.FormValue("id"))
+	if err != nil {
+		log.Printf(`move target: can't parse ID: %s`, err)
+		redirect(w, r, "/")
+		return
 	}
-	param := struct {
-		Envelopes  []*Envelope
-		TotalDelta struct {
-			Cls string
-			Val int
+	dst, err := uuid.Parse(r.FormValue("destination"))
+	if err != nil {
+		log.Printf(`move target: can't parse destination ID: %s`, err)
+		redirect(w, r, "/details?id="+src.String())
+		return
+	}
+
+	env, err := db.Envelope(src)
+	if err == nil && !env.VisibleTo(requestUser(r)) {
+		err = errNotFound
+	}
+	if err == nil {
+		var other *Envelope
+		if other, err = db.Envelope(dst); err == nil && !other.VisibleTo(requestUser(r)) {
+			err = errNotFound
+		}
+	}
+	if errors.Is(err, errNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf(`move target: can't get envelopes: %s`, err)
+		redirect(w, r, "/details?id="+src.String())
+		return
+	}
+
+	amount, err := lookupCurrency(env.Currency).Parse(r.FormValue("amount"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = db.TransferTarget(src, dst, amount)
+	if errors.Is(err, errInvalidValue) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf(`can't move target from %s to %s: %s`, src, dst, err)
+	}
+
+	redirect(w, r, "/details?id="+src.String())
+}
+
+func handleClone(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		redirect(w, r, "/")
+		return
+	}
+
+	id, err := uuid.Parse(r.FormValue("id"))
+	if err != nil {
+		log.Printf(`clone: can't parse ID: %s`, err)
+		redirect(w, r, "/")
+		return
+	}
+
+	if _, err := visibleEnvelope(db, id, requestUser(r)); errors.Is(err, errNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+
+	newId, err := db.CloneEnvelope(id, strings.TrimSpace(r.FormValue("name")))
+	if errors.Is(err, errNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if errors.Is(err, errInvalidValue) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf(`can't clone envelope %s: %s`, id, err)
+		redirect(w, r, "/details?id="+id.String())
+		return
+	}
+
+	redirect(w, r, "/details?id="+newId.String())
+}
+
+// overview is what the overview page shows.
+type overview struct {
+	page
+	Envelopes      []*Envelope `json:"envelopes"`
+	TotalDelta     int         `json:"total_delta"`
+	TotalBalance   int         `json:"total_balance"`
+	MonthTarget    int         `json:"month_target"`
+	MonthFunded    int         `json:"month_funded"`
+	MonthRemaining int         `json:"month_remaining"`
+	Archived       bool        `json:"archived"`
+	AsOf           string      `json:"as_of,omitempty"`
+}
+
+// gatherOverview collects the envelopes and totals for the overview. The show
+// and asof parameters of r select which envelopes are shown.
+func gatherOverview(db *DB, r *http.Request) (*overview, error) {
+	o := &overview{
+		Archived: r.FormValue("show") == "archived",
+		AsOf:     r.FormValue("asof"),
+	}
+
+	if o.AsOf != "" {
+		t, err := time.Parse("2006-01-02", o.AsOf)
+		if err != nil {
+			return nil, fmt.Errorf(`%w: invalid date %q`, errInvalidValue, o.AsOf)
 		}
-		TotalBalance int
-		MonthTarget  int
-	}{
-		es,
-		struct {
-			Cls string
-			Val int
-		}{dcls, delta},
-		balance,
-		monthtarget,
+		// Everything up to the end of that day
+		o.Envelopes = db.EnvelopesAsOf(t.AddDate(0, 0, 1).Add(-time.Second))
+	} else if o.Archived {
+		o.Envelopes = db.ArchivedEnvelopes()
+	} else {
+		o.Envelopes = db.AllEnvelopes()
 	}
+	o.Envelopes = visibleTo(o.Envelopes, requestUser(r))
 
-	if err := templ.ExecuteTemplate(w, "index.html", param); err != nil {
-		log.Printf(`error rendering overview template: %s`, err)
+	for _, e := range o.Envelopes {
+		// No exchange rates, so only the default currency counts
+		if e.Currency != defaultCurrency || e.ExcludeFromTotals {
+			continue
+		}
+		// Money owed counts against the total
+		if e.Liability {
+			o.TotalDelta += e.Target - e.Balance
+			o.TotalBalance -= e.Balance
+		} else {
+			o.TotalDelta += e.Balance - e.Target
+			o.TotalBalance += e.Balance
+		}
+		o.MonthTarget += e.MonthTarget
+
+		// Money put into an envelope this month counts towards its
+		// monthly target, up to the target itself
+		if e.MonthTarget > 0 {
+			o.MonthFunded += e.MonthTarget - e.MonthRemaining()
+		}
+		o.MonthRemaining += e.MonthRemaining()
 	}
+
+	return o, nil
+}
+
+func handleRequest(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Clients that poll the overview only get it again if it changed.
+	// Templates that are reloaded can change at any time.
+	if !reloadTemplates {
+		etag, err := overviewETag(db, r)
+		if err != nil {
+			log.Printf(`overview: can't compute ETag: %s`, err)
+		} else {
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Add("Vary", "Cookie")
+			if etagMatches(r, etag) {
+				w.Header().Add("Vary", "Accept")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+
+	o, err := gatherOverview(db, r)
+	if err != nil {
+		w.Header().Del("ETag")
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	o.page = pageFor(r)
+	render(w, r, "index.html", o)
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
 }
 
 func main() {
+	listen := flag.String("listen", envOr("ENVELOPES_LISTEN", "127.0.0.1:8081"), "address to listen on")
+	flag.StringVar(&defaultCurrency, "currency", envOr("ENVELOPES_CURRENCY", defaultCurrency), "default currency for new envelopes and totals")
+	flag.StringVar(&routePrefix, "prefix", envOr("ENVELOPES_PREFIX", ""), "path prefix to serve under, e.g. /budget")
+	flag.StringVar(&templateDir, "templates", envOr("ENVELOPES_TEMPLATES", templateDir), "directory to load the page templates from")
+	flag.BoolVar(&reloadTemplates, "dev", os.Getenv("ENVELOPES_DEV") != "", "reload templates for every request")
+	dataDir := flag.String("data-dir", envOr("ENVELOPES_DATA_DIR", "."), "directory to keep the DB in")
+	uploads := flag.String("uploads-dir", envOr("ENVELOPES_UPLOADS_DIR", uploadsDir), "directory in the data directory to store uploaded receipts in")
+	backupDir := flag.String("backup-dir", envOr("ENVELOPES_BACKUP_DIR", ""), "directory to write DB backups to, backups in the data directory by default")
+	defaultInterval, err := time.ParseDuration(envOr("ENVELOPES_BACKUP_INTERVAL", "24h"))
+	if err != nil {
+		log.Fatalf(`invalid ENVELOPES_BACKUP_INTERVAL: %s`, err)
+	}
+	backupInterval := flag.Duration("backup-interval", defaultInterval, "how often to back up the DB, 0 to disable")
+	defaultStartDay, err := strconv.Atoi(envOr("ENVELOPES_MONTH_START", "1"))
+	if err != nil {
+		log.Fatalf(`invalid ENVELOPES_MONTH_START: %s`, err)
+	}
+	flag.IntVar(&monthStartDay, "month-start", defaultStartDay, "day of the month on which budget months start")
+	defaultUnit, err := strconv.Atoi(envOr("ENVELOPES_SPREAD_UNIT", "1"))
+	if err != nil {
+		log.Fatalf(`invalid ENVELOPES_SPREAD_UNIT: %s`, err)
+	}
+	flag.IntVar(&spreadUnit, "spread-unit", defaultUnit, "smallest amount in cents to hand out when spreading, e.g. 100 for whole euros")
+	flag.StringVar(&spreadLeftover, "spread-leftover", envOr("ENVELOPES_SPREAD_LEFTOVER", spreadLeftover), "where the leftover of a spread goes: remainder, source or savings")
+	savingsId := flag.String("spread-savings", envOr("ENVELOPES_SPREAD_SAVINGS", ""), "ID of the envelope that gets the leftover of a spread with -spread-leftover savings")
+	defaultNear, err := strconv.Atoi(envOr("ENVELOPES_DELTA_NEAR", "5"))
+	if err != nil {
+		log.Fatalf(`invalid ENVELOPES_DELTA_NEAR: %s`, err)
+	}
+	flag.IntVar(&deltaNearPercent, "delta-near", defaultNear, "percentage of the target an envelope may miss it by to be shown as nearly there, 0 to always warn")
+	defaultMin, err := strconv.Atoi(envOr("ENVELOPES_TX_MIN", "0"))
+	if err != nil {
+		log.Fatalf(`invalid ENVELOPES_TX_MIN: %s`, err)
+	}
+	flag.IntVar(&minTxAmount, "tx-min", defaultMin, "smallest amount in cents a single transaction may have, 0 for no limit")
+	defaultMax, err := strconv.Atoi(envOr("ENVELOPES_TX_MAX", "0"))
+	if err != nil {
+		log.Fatalf(`invalid ENVELOPES_TX_MAX: %s`, err)
+	}
+	flag.IntVar(&maxTxAmount, "tx-max", defaultMax, "largest amount in cents a single transaction may have, 0 for no limit")
+	defaultUndo, err := time.ParseDuration(envOr("ENVELOPES_UNDO_WINDOW", "0s"))
+	if err != nil {
+		log.Fatalf(`invalid ENVELOPES_UNDO_WINDOW: %s`, err)
+	}
+	flag.DurationVar(&undoWindow, "undo-window", defaultUndo, "how long balance changes can be undone before they are final, 0 to make them final right away")
+	defaultKeep, err := strconv.Atoi(envOr("ENVELOPES_KEEP_MONTHS", "0"))
+	if err != nil {
+		log.Fatalf(`invalid ENVELOPES_KEEP_MONTHS: %s`, err)
+	}
+	flag.IntVar(&keepMonths, "keep-months", defaultKeep, "budget months of history to keep before the current one, older history is pruned daily, 0 to keep all of it")
+	pprofAddr := flag.String("pprof", envOr("ENVELOPES_PPROF", ""), "address to serve pprof on, e.g. 127.0.0.1:6060, empty to disable")
+	flag.Parse()
+
+	if spreadUnit < 1 {
+		log.Fatalf(`spread unit must be at least 1, not %d`, spreadUnit)
+	}
+	switch spreadLeftover {
+	case LeftoverRemainder, LeftoverSource:
+		/* nothing */
+	case LeftoverSavings:
+		if spreadSavings, err = uuid.Parse(*savingsId); err != nil {
+			log.Fatalf(`invalid savings envelope %q for the spread leftover: %s`, *savingsId, err)
+		}
+	default:
+		log.Fatalf(`unknown spread leftover policy %q`, spreadLeftover)
+	}
+
+	if minTxAmount > 0 && maxTxAmount > 0 && minTxAmount > maxTxAmount {
+		log.Fatalf(`minimum transaction amount %d is above the maximum %d`, minTxAmount, maxTxAmount)
+	}
+
+	if *backupDir == "" {
+		*backupDir = filepath.Join(*dataDir, "backups")
+	}
+	presetsFile = filepath.Join(*dataDir, presetsFile)
+	uploadsDir = filepath.Join(*dataDir, *uploads)
+
+	if keepMonths < 0 {
+		log.Fatalf(`number of months to keep must not be negative, not %d`, keepMonths)
+	}
+
+	if monthStartDay < 1 || monthStartDay > 31 {
+		log.Fatalf(`month start day must be between 1 and 31, not %d`, monthStartDay)
+	}
+
+	routePrefix = strings.TrimRight(routePrefix, "/")
+	if routePrefix != "" && !strings.HasPrefix(routePrefix, "/") {
+		routePrefix = "/" + routePrefix
+	}
+
+	if _, ok := currencies[defaultCurrency]; !ok {
+		log.Fatalf(`unknown currency %s`, defaultCurrency)
+	}
+
+	if flag.NArg() > 0 {
+		db, err := OpenDB(*dataDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = runCommand(db, os.Stdout, flag.Args())
+		if cerr := db.Close(); cerr != nil {
+			log.Printf(`error while saving DB: %s`, cerr)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if templ, err = loadTemplates(templateDir); err != nil {
+		log.Fatalf(`can't load templates: %s`, err)
+	}
+
 	log.Printf("Here we go")
 
-	db, err := OpenDB()
+	password := os.Getenv("ENVELOPES_PASSWORD")
+	if password == "" {
+		log.Printf(`ENVELOPES_PASSWORD not set, authentication is disabled`)
+	}
+
+	db, err := OpenDB(*dataDir)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -322,29 +1265,139 @@ func main() {
 		}
 	}()
 
-	http.Handle("/static/", http.FileServer(http.Dir(".")))
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	if *backupInterval > 0 {
+		go backupEvery(db, *backupDir, *backupInterval)
+	}
+
+	if keepMonths > 0 {
+		go pruneEvery(db, 24*time.Hour)
+	}
+
+	if *pprofAddr != "" {
+		go servePprof(*pprofAddr)
+	}
+
+	mux := http.NewServeMux()
+	// Only serve the assets, not the DB next to them
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	mux.HandleFunc("/", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
 		handleRequest(db, w, r)
-	})
-	http.HandleFunc("/update", func(w http.ResponseWriter, r *http.Request) {
+	}))
+	mux.HandleFunc("/update", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
 		handleUpdateRequest(db, w, r)
-	})
-	http.HandleFunc("/delete", func(w http.ResponseWriter, r *http.Request) {
+	}))
+	mux.HandleFunc("/delete", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
 		handleDeleteRequest(db, w, r)
-	})
-	http.HandleFunc("/details", func(w http.ResponseWriter, r *http.Request) {
+	}))
+	mux.HandleFunc("/details", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
 		handleDetail(db, w, r)
-	})
-	http.HandleFunc("/spread", func(w http.ResponseWriter, r *http.Request) {
+	}))
+	mux.HandleFunc("/spread", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
 		handleSpread(db, w, r)
-	})
-	http.HandleFunc("/tx", func(w http.ResponseWriter, r *http.Request) {
+	}))
+	mux.HandleFunc("/tx", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
 		handleTx(db, w, r)
-	})
-	http.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
-		handleDebug(w, r)
-	})
-	err = http.ListenAndServe("127.0.0.1:8081", nil)
+	}))
+	mux.HandleFunc("/tx/split", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleSplit(db, w, r)
+	}))
+	mux.HandleFunc("/reverse", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleReverse(db, w, r)
+	}))
+	mux.HandleFunc("/undo", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleUndo(db, w, r)
+	}))
+	mux.HandleFunc("/archive", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleArchive(db, w, r)
+	}))
+	mux.HandleFunc("/reorder", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleReorder(db, w, r)
+	}))
+	mux.HandleFunc("/merge", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleMerge(db, w, r)
+	}))
+	mux.HandleFunc("/movetarget", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleMoveTarget(db, w, r)
+	}))
+	mux.HandleFunc("/clone", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleClone(db, w, r)
+	}))
+	mux.HandleFunc("/plan", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handlePlan(db, w, r)
+	}))
+	mux.HandleFunc("/tags", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleTags(db, w, r)
+	}))
+	mux.HandleFunc("/summary", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleSummary(db, w, r)
+	}))
+	mux.HandleFunc("/theme", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleTheme(db, w, r)
+	}))
+	mux.HandleFunc("/setup", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleSetup(db, w, r)
+	}))
+	mux.HandleFunc("/search", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleSearch(db, w, r)
+	}))
+	mux.HandleFunc("/activity", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleActivity(db, w, r)
+	}))
+	mux.HandleFunc("/attachments/{name}", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleAttachment(db, w, r)
+	}))
+	mux.HandleFunc("/api/tx", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleAPITx(db, w, r)
+	}))
+	mux.HandleFunc("/api/envelopes", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleAPIEnvelopes(db, w, r)
+	}))
+	mux.HandleFunc("/api/envelopes/{id}", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleAPIEnvelope(db, w, r)
+	}))
+	mux.HandleFunc("/api/envelopes/{id}/series", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleAPIEnvelopeSeries(db, w, r)
+	}))
+	mux.HandleFunc("/api/events/{id}", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleAPIEvent(db, w, r)
+	}))
+	mux.HandleFunc("/api/history/totals", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleAPIHistoryTotals(db, w, r)
+	}))
+	mux.HandleFunc("/admin/backup", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleBackup(db, *backupDir, w, r)
+	}))
+	mux.HandleFunc("/admin/export", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleExport(db, w, r)
+	}))
+	mux.HandleFunc("/admin/restore", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleRestore(db, w, r)
+	}))
+	mux.HandleFunc("/admin/conflicts", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleConflicts(db, w, r)
+	}))
+	mux.HandleFunc("/admin/verify", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleVerify(db, w, r)
+	}))
+	mux.HandleFunc("/admin/rebuild", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleRebuild(db, w, r)
+	}))
+	mux.HandleFunc("/admin/prune", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handlePrune(db, w, r)
+	}))
+	mux.HandleFunc("/debug", requireAuth(password, func(w http.ResponseWriter, r *http.Request) {
+		handleDebug(db, w, r)
+	}))
+
+	var handler http.Handler = mux
+	if routePrefix != "" {
+		root := http.NewServeMux()
+		root.Handle(routePrefix+"/", http.StripPrefix(routePrefix, mux))
+		root.Handle(routePrefix, http.RedirectHandler(routePrefix+"/", http.StatusMovedPermanently))
+		handler = root
+	}
+
+	err = http.ListenAndServe(*listen, logRequests(handler))
 	if err != nil {
 		log.Printf(`HTTP died: %s`, err)
 	}
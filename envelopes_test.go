@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestUpdateRequestInvalidAmount(t *testing.T) {
+	db := newTestDB(t)
+	id := newTestEnvelope(t, db, "rent", 0)
+	if err := db.UpdateEnvelopeMeta(id, func(e *Envelope) { e.Target = 200000 }); err != nil {
+		t.Fatal(err)
+	}
+
+	// "1.500" could be one and a half or fifteen hundred
+	form := url.Values{"env-id": {id.String()}, "env-name": {"rent"}, "env-target": {"1.500"}}
+	r := httptest.NewRequest("POST", "/update", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handleUpdateRequest(db, w, r)
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "ambiguous") {
+		t.Errorf(`got %d %q, want 400 with the parse error`, w.Code, w.Body.String())
+	}
+	if e := mustEnvelope(t, db, id); e.Target != 200000 {
+		t.Errorf(`target is %d, want it unchanged`, e.Target)
+	}
+
+	// The same goes for the fields of the details page
+	for _, field := range []string{"env-monthcap", "env-goalamount"} {
+		form := url.Values{"env-id": {id.String()}, "env-name": {"rent"}, "env-goalamount": {""}, field: {"0.001"}}
+		r := httptest.NewRequest("POST", "/update", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handleUpdateRequest(db, w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf(`%s: got %d, want 400`, field, w.Code)
+		}
+	}
+}
+
+func TestTxCapWarning(t *testing.T) {
+	db := newTestDB(t)
+	id := newTestEnvelope(t, db, "dining", 0)
+	if err := db.UpdateEnvelopeMeta(id, func(e *Envelope) { e.MonthCap = 5000 }); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second one goes over the cap
+	for i, amount := range []string{"40", "20"} {
+		want := i == 1
+		form := url.Values{"id": {id.String()}, "dir": {"out"}, "amount": {amount}, "token": {uuid.NewString()}}
+		r := httptest.NewRequest("POST", "/tx", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handleTx(db, w, r)
+
+		if got := strings.Contains(w.Header().Get("Location"), "overcap=1"); got != want {
+			t.Errorf(`spending %s: redirected to %q, want a warning: %t`, amount, w.Header().Get("Location"), want)
+		}
+	}
+}
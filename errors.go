@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Errors returned by DB methods wrap one of errNotFound, errInvalidValue or
+// errStorage, so handlers can tell them apart with errors.Is.
+var (
+	// errNotFound is wrapped by errors about envelopes or events that don't
+	// exist.
+	errNotFound = errors.New("not found")
+	// errStorage is wrapped by errors of the underlying database.
+	errStorage = errors.New("storage failure")
+)
+
+// dbError classifies err for callers of the DB: sql.ErrNoRows becomes
+// errNotFound, and anything not classified yet is a storage failure.
+func dbError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errNotFound), errors.Is(err, errInvalidValue), errors.Is(err, errInvalidTx),
+		errors.Is(err, errStaleVersion), errors.Is(err, errStorage):
+		return err
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf(`%w: %w`, errNotFound, err)
+	default:
+		return fmt.Errorf(`%w: %w`, errStorage, err)
+	}
+}
+
+// errorStatus returns the HTTP status code for err.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errInvalidValue), errors.Is(err, errInvalidTx):
+		return http.StatusBadRequest
+	case errors.Is(err, errStaleVersion), errors.Is(err, errNotPending):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Pages rendered by an earlier run may differ even if the DB didn't change,
+// e.g. after an update or with different flags.
+var startedAt = time.Now().UnixNano()
+
+// Version changes whenever something is committed to the DB. It is made of
+// the newest event, which also catches events written by other processes, and
+// a count of the changes since the DB was opened, which catches changes that
+// aren't events, like reordering.
+func (d *DB) Version() (string, error) {
+	var latest string
+	err := d.db.QueryRow(`SELECT id FROM history ORDER BY seq DESC LIMIT 1`).Scan(&latest)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", dbError(err)
+	}
+	return fmt.Sprintf(`%s-%d`, latest, d.generation.Load()), nil
+}
+
+// overviewETag returns a weak ETag for the overview as r asks for it. Besides
+// the DB version, it depends on everything else that the page does: the
+// budget month, the selected view, the user, the theme and the format.
+func overviewETag(db *DB, r *http.Request) (string, error) {
+	version, err := db.Version()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%s\n%s\n", startedAt, version, budgetMonthOf(time.Now()).Format(dateFormat))
+	fmt.Fprintf(h, "%s\n%s\n%s\n", r.FormValue("show"), r.FormValue("asof"), requestUser(r))
+	fmt.Fprintf(h, "%s\n%t\n", pageFor(r).Theme, wantsJSON(r))
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`, nil
+}
+
+// etagMatches returns whether the If-None-Match header of r lists etag. As
+// for GET requests, the comparison is weak.
+func etagMatches(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenWindow is how long a form token is remembered. Submitting a form
+// again with the same token within this window does nothing.
+const tokenWindow = 30 * time.Minute
+
+// tokenCache remembers recently used form tokens.
+type tokenCache struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+var txTokens = &tokenCache{used: map[string]time.Time{}}
+
+// claim records token and returns true, unless it was already claimed within
+// the window. An empty token can always be claimed.
+func (c *tokenCache) claim(token string) bool {
+	if token == "" {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for t, at := range c.used {
+		if now.Sub(at) > tokenWindow {
+			delete(c.used, t)
+		}
+	}
+
+	if _, ok := c.used[token]; ok {
+		return false
+	}
+	c.used[token] = now
+	return true
+}
+
+// release forgets token, so that a form which failed can be submitted again.
+func (c *tokenCache) release(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.used, token)
+}
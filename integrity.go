@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// Discrepancy is a value of an envelope that doesn't match its history.
+type Discrepancy struct {
+	EnvelopeId uuid.UUID `json:"envelope_id"`
+	Name       string    `json:"name"`
+	Field      string    `json:"field"`
+	Stored     int       `json:"stored"`
+	Computed   int       `json:"computed"`
+}
+
+// replayWithTx computes the envelope with the given ID from scratch by
+// applying its history in the order it was merged.
+func (d *DB) replayWithTx(tx *sql.Tx, id uuid.UUID) (*Envelope, error) {
+	rows, err := tx.Query(`SELECT `+eventColumns+` FROM history WHERE envelope = $1 ORDER BY seq`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	e := &Envelope{Id: id, Currency: defaultCurrency}
+	for rows.Next() {
+		evt, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		e.apply(evt)
+	}
+
+	return e, rows.Err()
+}
+
+// envelopeIdsWithTx returns the IDs of all envelopes that aren't deleted.
+func envelopeIdsWithTx(tx *sql.Tx) ([]uuid.UUID, error) {
+	rows, err := tx.Query(`SELECT id FROM envelopes WHERE not deleted ORDER BY sortorder, name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// VerifyIntegrity compares balance and targets of every envelope with the
+// ones its history adds up to.
+func (d *DB) VerifyIntegrity() ([]Discrepancy, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids, err := envelopeIdsWithTx(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	found := []Discrepancy{}
+	for _, id := range ids {
+		stored, err := d.envelopeWithTx(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		computed, err := d.replayWithTx(tx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range []struct {
+			name             string
+			stored, computed int
+		}{
+			{"balance", stored.Balance, computed.Balance},
+			{"target", stored.Target, computed.Target},
+			{"monthtarget", stored.MonthTarget, computed.MonthTarget},
+		} {
+			if f.stored != f.computed {
+				found = append(found, Discrepancy{id, stored.Name, f.name, f.stored, f.computed})
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// RebuildFromHistory recomputes the envelope with the given ID from its
+// history and stores the result. This only repairs the local DB, nothing is
+// added to the history.
+func (d *DB) RebuildFromHistory(id uuid.UUID) error {
+	return dbError(d.rebuild(func(tx *sql.Tx) ([]uuid.UUID, error) {
+		if _, err := d.envelopeWithTx(tx, id); err != nil {
+			return nil, err
+		}
+		return []uuid.UUID{id}, nil
+	}))
+}
+
+// RebuildAllFromHistory is RebuildFromHistory for all envelopes.
+func (d *DB) RebuildAllFromHistory() error {
+	return dbError(d.rebuild(envelopeIdsWithTx))
+}
+
+func (d *DB) rebuild(ids func(tx *sql.Tx) ([]uuid.UUID, error)) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	todo, err := ids(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range todo {
+		e, err := d.replayWithTx(tx, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Stmt(d.stmts.updateEnvelope).Exec(e.Name, e.Balance, e.Target, e.MonthTarget, false,
+			e.Currency, e.Archived, e.GoalAmount, e.GoalDate, e.Liability, e.ExcludeFromTotals,
+			e.Owner, e.AutoSpread, e.MonthCap, e.metaDate, e.metaEvent, e.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf(`rebuilt %d envelopes from their history`, len(todo))
+
+	return d.persist()
+}
+
+func handleVerify(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	writeIntegrity(db, w)
+}
+
+// writeIntegrity responds with the discrepancies VerifyIntegrity finds.
+func writeIntegrity(db *DB, w http.ResponseWriter) {
+	found, err := db.VerifyIntegrity()
+	if err != nil {
+		log.Printf(`integrity check failed: %s`, err)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("integrity check failed"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Discrepancies []Discrepancy `json:"discrepancies"`
+	}{found})
+}
+
+// handleRebuild rebuilds the envelope given in the id parameter from its
+// history, or all of them if there is none.
+func handleRebuild(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	var err error
+	if r.FormValue("id") == "" {
+		err = db.RebuildAllFromHistory()
+	} else {
+		id, perr := uuid.Parse(r.FormValue("id"))
+		if perr != nil {
+			writeJSONError(w, http.StatusBadRequest, perr)
+			return
+		}
+		err = db.RebuildFromHistory(id)
+	}
+	if errors.Is(err, errNotFound) {
+		writeJSONError(w, http.StatusNotFound, errors.New("no such envelope"))
+		return
+	} else if err != nil {
+		log.Printf(`rebuild failed: %s`, err)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("rebuild failed"))
+		return
+	}
+
+	// What's left can't be fixed by replaying the history
+	writeIntegrity(db, w)
+}
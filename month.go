@@ -0,0 +1,32 @@
+package main
+
+import (
+	"time"
+)
+
+// monthStartDay is the day of the month on which a budget month starts, for
+// example the day the salary comes in. If a month is too short, its budget
+// month starts on its last day instead.
+var monthStartDay = 1
+
+// budgetMonthStart returns the start of the budget month that is named after
+// the given calendar month.
+func budgetMonthStart(year int, month time.Month) time.Time {
+	day := monthStartDay
+	// Day 0 of the next month is the last day of this one
+	if last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day(); day > last {
+		day = last
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// budgetMonthOf returns the start of the budget month t is in.
+func budgetMonthOf(t time.Time) time.Time {
+	t = t.UTC()
+	start := budgetMonthStart(t.Year(), t.Month())
+	if t.Before(start) {
+		prev := start.AddDate(0, 0, -start.Day()+1).AddDate(0, -1, 0)
+		start = budgetMonthStart(prev.Year(), prev.Month())
+	}
+	return start
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+)
+
+var nickAdjectives = []string{
+	"agile", "bold", "brave", "bright", "calm", "clever", "cosy", "curious",
+	"eager", "fancy", "fierce", "gentle", "happy", "jolly", "keen", "kind",
+	"lively", "lucky", "merry", "mighty", "nimble", "patient", "proud", "quick",
+	"quiet", "rapid", "shy", "sleepy", "steady", "swift", "tidy", "witty",
+}
+
+var nickNouns = []string{
+	"badger", "beaver", "bison", "crane", "dingo", "dolphin", "falcon", "ferret",
+	"finch", "fox", "gecko", "heron", "ibex", "jackal", "koala", "lemur",
+	"lynx", "marmot", "moose", "newt", "otter", "owl", "panda", "puffin",
+	"quokka", "raven", "seal", "sloth", "stoat", "tapir", "walrus", "wombat",
+}
+
+func randomWord(words []string) (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+	if err != nil {
+		return "", err
+	}
+	return words[n.Int64()], nil
+}
+
+// randomNick returns a human readable name like "brave-otter".
+func randomNick() (string, error) {
+	adj, err := randomWord(nickAdjectives)
+	if err != nil {
+		return "", err
+	}
+	noun, err := randomWord(nickNouns)
+	if err != nil {
+		return "", err
+	}
+	return adj + "-" + noun, nil
+}
+
+// instanceName returns the name this instance records as the origin of its
+// events. It is picked on first start and stored in the settings table. A new
+// name is never one that already shows up as the origin of another
+// instance's events.
+func (d *DB) instanceName() (string, error) {
+	var name string
+	err := d.db.QueryRow(`SELECT value FROM settings WHERE key = 'nick'`).Scan(&name)
+	if err == nil {
+		return name, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	known := map[string]bool{}
+	rows, err := d.db.Query(`SELECT DISTINCT origin FROM history`)
+	if err != nil {
+		return "", err
+	}
+	for rows.Next() {
+		var origin string
+		if err := rows.Scan(&origin); err != nil {
+			rows.Close()
+			return "", err
+		}
+		known[origin] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	for i := 0; name == "" || known[name]; i++ {
+		if name, err = randomNick(); err != nil {
+			return "", err
+		}
+		if i >= 10 {
+			// Running out of names, make collisions unlikely again
+			n, err := rand.Int(rand.Reader, big.NewInt(1000))
+			if err != nil {
+				return "", err
+			}
+			name = fmt.Sprintf("%s-%d", name, n)
+		}
+	}
+
+	if _, err := d.db.Exec(`INSERT INTO settings (key, value) VALUES ('nick', $1)`, name); err != nil {
+		return "", err
+	}
+	log.Printf(`this instance is now known as %s`, name)
+
+	return name, nil
+}
+
+// SetInstanceName changes the name this instance records as the origin of
+// its events, for example to keep the name of an instance that moved to a
+// new machine. Events recorded before keep their origin.
+func (d *DB) SetInstanceName(name string) error {
+	name, err := cleanText("instance name", strings.TrimSpace(name), maxNameLength)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf(`%w: empty instance name`, errInvalidValue)
+	}
+
+	if _, err := d.db.Exec(`INSERT OR REPLACE INTO settings (key, value) VALUES ('nick', $1)`, name); err != nil {
+		return err
+	}
+	if err := d.persist(); err != nil {
+		return err
+	}
+	d.origin = name
+	log.Printf(`this instance is now known as %s`, name)
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// requestUser returns the user name the request was authenticated with, or
+// an empty string if there is none. Everyone shares the password, so user
+// names only keep envelope sets apart, they don't protect them.
+func requestUser(r *http.Request) string {
+	user, _, _ := r.BasicAuth()
+	return strings.ToLower(strings.TrimSpace(user))
+}
+
+// VisibleTo returns whether user sees the envelope. Without a user name, all
+// envelopes are shown.
+func (e *Envelope) VisibleTo(user string) bool {
+	return user == "" || e.Owner == "" || e.Owner == user
+}
+
+// visibleTo returns the envelopes user sees.
+func visibleTo(envelopes []*Envelope, user string) []*Envelope {
+	rv := []*Envelope{}
+	for _, e := range envelopes {
+		if e.VisibleTo(user) {
+			rv = append(rv, e)
+		}
+	}
+	return rv
+}
+
+// visibleIds returns the IDs of the envelopes, including archived ones, that
+// user sees.
+func visibleIds(db *DB, user string) map[uuid.UUID]bool {
+	ids := map[uuid.UUID]bool{}
+	for _, e := range visibleTo(append(db.AllEnvelopes(), db.ArchivedEnvelopes()...), user) {
+		ids[e.Id] = true
+	}
+	return ids
+}
+
+// visibleEvents returns the events of envelopes user sees.
+func visibleEvents(db *DB, events []Event, user string) []Event {
+	if user == "" {
+		return events
+	}
+
+	ids := visibleIds(db, user)
+	rv := []Event{}
+	for _, e := range events {
+		if ids[e.EnvelopeId] {
+			rv = append(rv, e)
+		}
+	}
+	return rv
+}
+
+// visibleEnvelope returns the envelope with the given ID if user sees it.
+// Envelopes of other users are errNotFound, as if they didn't exist.
+func visibleEnvelope(db *DB, id uuid.UUID, user string) (*Envelope, error) {
+	env, err := db.Envelope(id)
+	if err != nil {
+		return nil, err
+	}
+	if !env.VisibleTo(user) {
+		return nil, fmt.Errorf(`%w: envelope %s`, errNotFound, id)
+	}
+	return env, nil
+}
+
+// visibleEvent returns the event with the given ID if user sees its envelope.
+func visibleEvent(db *DB, id uuid.UUID, user string) (*Event, error) {
+	evt, err := db.Event(id)
+	if err != nil || user == "" {
+		return evt, err
+	}
+	if _, err := visibleEnvelope(db, evt.EnvelopeId, user); err != nil {
+		return nil, err
+	}
+	return evt, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// presetsFile holds the presets users defined themselves. It is a JSON object
+// that maps the name of each preset to its envelopes, in the format of the
+// envelope API. Presets in it replace built-in ones of the same name.
+var presetsFile = "presets.json"
+
+func presetEnvelope(name string, monthTarget int) envelopeRequest {
+	return envelopeRequest{Name: &name, MonthTarget: &monthTarget}
+}
+
+// defaultPresets are always available. Targets are in the default currency.
+var defaultPresets = map[string][]envelopeRequest{
+	"basic": {
+		presetEnvelope("Rent", 80000),
+		presetEnvelope("Groceries", 40000),
+		presetEnvelope("Utilities", 15000),
+		presetEnvelope("Savings", 20000),
+	},
+	"household": {
+		presetEnvelope("Rent", 120000),
+		presetEnvelope("Groceries", 70000),
+		presetEnvelope("Utilities", 25000),
+		presetEnvelope("Insurance", 15000),
+		presetEnvelope("Transport", 15000),
+		presetEnvelope("Kids", 20000),
+		presetEnvelope("Fun", 10000),
+		presetEnvelope("Savings", 30000),
+	},
+}
+
+// loadPresets returns the built-in presets together with the ones in
+// presetsFile, if there is one.
+func loadPresets() (map[string][]envelopeRequest, error) {
+	presets := map[string][]envelopeRequest{}
+	for name, envelopes := range defaultPresets {
+		presets[name] = envelopes
+	}
+
+	f, err := os.Open(presetsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return presets, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	own := map[string][]envelopeRequest{}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&own); err != nil {
+		return nil, fmt.Errorf(`can't parse %s: %w`, presetsFile, err)
+	}
+	for name, envelopes := range own {
+		for _, e := range envelopes {
+			if err := e.validate(); err != nil {
+				return nil, fmt.Errorf(`preset %s in %s: %w`, name, presetsFile, err)
+			}
+		}
+		presets[name] = envelopes
+	}
+
+	return presets, nil
+}
+
+// presetNames returns the names of all presets, sorted.
+func presetNames() []string {
+	presets, err := loadPresets()
+	if err != nil {
+		log.Printf(`can't load presets: %s`, err)
+		return nil
+	}
+
+	names := []string{}
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ApplyPreset creates the envelopes of a preset for user, all at once.
+func (d *DB) ApplyPreset(envelopes []envelopeRequest, user string) ([]uuid.UUID, error) {
+	updates := []func(e *Envelope){}
+	for _, req := range envelopes {
+		updates = append(updates, func(e *Envelope) {
+			e.Owner = user
+			req.update(e)
+		})
+	}
+	return d.CreateEnvelopes(updates)
+}
+
+// handleSetup lists the presets, or creates the envelopes of the one named
+// by the preset parameter.
+func handleSetup(db *DB, w http.ResponseWriter, r *http.Request) {
+	presets, err := loadPresets()
+	if err != nil {
+		log.Printf(`setup: can't load presets: %s`, err)
+		renderError(w, r, http.StatusInternalServerError, errors.New("can't load presets"))
+		return
+	}
+
+	if r.Method != "POST" {
+		writeJSON(w, http.StatusOK, presets)
+		return
+	}
+
+	envelopes, ok := presets[r.FormValue("preset")]
+	if !ok {
+		renderError(w, r, http.StatusNotFound, errors.New("no such preset"))
+		return
+	}
+
+	ids, err := db.ApplyPreset(envelopes, requestUser(r))
+	if errors.Is(err, errInvalidValue) {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		log.Printf(`setup: can't apply preset %s: %s`, r.FormValue("preset"), err)
+		renderError(w, r, http.StatusInternalServerError, errors.New("can't apply preset"))
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusCreated, struct {
+			Envelopes []uuid.UUID `json:"envelopes"`
+		}{ids})
+		return
+	}
+	redirect(w, r, "/")
+}
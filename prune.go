@@ -0,0 +1,248 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// keepMonths is how many budget months of history are kept before the current
+// one when it is pruned automatically, 0 keeps all of it.
+var keepMonths = 0
+
+// retentionCutoff returns the start of the oldest budget month that is kept
+// when months of history are kept before the one now is in.
+func retentionCutoff(now time.Time, months int) time.Time {
+	start := budgetMonthOf(now)
+	return budgetMonthStart(start.Year(), start.Month()-time.Month(months))
+}
+
+// pruneEvery prunes the history that is older than keepMonths, once right
+// away and then once per interval.
+func pruneEvery(db *DB, interval time.Duration) {
+	for {
+		if err := db.PruneHistory(retentionCutoff(time.Now(), keepMonths)); err != nil {
+			log.Printf(`scheduled pruning failed: %s`, err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// PruneHistory collapses the history of every envelope from before the
+// cutoff into a single opening event that carries the balance and metadata
+// the pruned events added up to. Replaying what is left gives exactly the
+// envelope the whole history did, envelopes for which it wouldn't are left
+// alone.
+//
+// Changes that can still be undone are kept, see Undo.
+//
+// Pruning is final: once an envelope has an opening event, Restore skips
+// events from before it, including the ones that were pruned, so instances
+// that still have them can't bring them back. Changes made from before the
+// cutoff that didn't reach this instance yet are lost as well, so only prune
+// history all instances have exchanged.
+func (d *DB) PruneHistory(before time.Time) error {
+	cutoff := before.UTC().Format(dateFormat)
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback()
+
+	ids, err := envelopeIdsWithTx(tx)
+	if err != nil {
+		return dbError(err)
+	}
+
+	pruned := 0
+	for _, id := range ids {
+		n, err := d.pruneEnvelopeWithTx(tx, id, cutoff)
+		if err != nil {
+			return dbError(err)
+		}
+		pruned += n
+	}
+	if pruned == 0 {
+		return nil
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM conflicts
+		WHERE event NOT IN (SELECT id FROM history) OR winner NOT IN (SELECT id FROM history)`)
+	if err != nil {
+		return dbError(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return dbError(err)
+	}
+	log.Printf(`pruned %d events from before %s`, pruned, cutoff)
+
+	return dbError(d.persist())
+}
+
+// pruneEnvelopeWithTx replaces the history of the envelope with the given ID
+// from before cutoff with an opening event, and returns how many events it
+// removed.
+func (d *DB) pruneEnvelopeWithTx(tx *sql.Tx, id uuid.UUID, cutoff string) (int, error) {
+	rows, err := tx.Query(`
+		SELECT `+eventColumns+`
+		FROM history
+		WHERE envelope = $1 AND date < $2 AND pendinguntil = ''
+		ORDER BY seq`, id, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	old := []Event{}
+	for rows.Next() {
+		evt, err := scanEvent(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		old = append(old, evt)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	// A single event is as short as it gets
+	if len(old) < 2 {
+		return 0, nil
+	}
+
+	want, err := d.replayWithTx(tx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	sum := &Envelope{Id: id, Currency: defaultCurrency}
+	date := ""
+	for _, evt := range old {
+		sum.apply(evt)
+		date = max(date, evt.Date)
+	}
+
+	// The opening event is as old as the newest event it replaces, so it
+	// loses against all metadata changes that are kept
+	opening := Event{
+		EnvelopeId:  id,
+		Id:          uuid.New(),
+		Date:        date,
+		Origin:      d.origin,
+		Name:        want.Name,
+		Balance:     sum.Balance,
+		Target:      sum.Target,
+		MonthTarget: sum.MonthTarget,
+		Comment:     "Opening balance",
+		Currency:    sum.Currency,
+		Kind:        KindOpening,
+	}
+	if sum.metaEvent != uuid.Nil {
+		opening = d.metaEvent(&Envelope{Id: id}, sum)
+		opening.Date = date
+		opening.Balance = sum.Balance
+		opening.Comment = "Opening balance"
+		opening.Kind = KindOpening
+	}
+
+	// The savepoint lets this envelope be left alone without giving up on
+	// the others
+	if _, err := tx.Exec(`SAVEPOINT prune`); err != nil {
+		return 0, err
+	}
+
+	var first int64
+	err = tx.QueryRow(`SELECT min(seq) FROM history WHERE envelope = $1 AND date < $2 AND pendinguntil = ''`,
+		id, cutoff).Scan(&first)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`DELETE FROM history WHERE envelope = $1 AND date < $2 AND pendinguntil = ''`, id, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	if err := d.insertEventWithTx(tx, opening); err != nil {
+		return 0, err
+	}
+	// Events are replayed in the order they were merged, so the opening
+	// event takes the place of the first one it replaces
+	if _, err := tx.Exec(`UPDATE history SET seq = $1 WHERE id = $2`, first, opening.Id); err != nil {
+		return 0, err
+	}
+
+	got, err := d.replayWithTx(tx, id)
+	if err != nil {
+		return 0, err
+	}
+	if got.Balance != want.Balance || !got.sameMeta(want) {
+		log.Printf(`pruning the history of %s would change it, keeping all of it`, id)
+		if _, err := tx.Exec(`ROLLBACK TO prune`); err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`RELEASE prune`)
+		return 0, err
+	}
+
+	_, err = tx.Exec(`UPDATE envelopes SET metadate = $1, metaevent = $2 WHERE id = $3`, got.metaDate, got.metaEvent, id)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`RELEASE prune`); err != nil {
+		return 0, err
+	}
+
+	return len(old), nil
+}
+
+// coveredWithTx returns whether e is from before the history of its envelope
+// was pruned, so it shouldn't be merged. For an opening event, that's the case
+// if the history it stands for is still there.
+func coveredWithTx(tx *sql.Tx, e Event) (bool, error) {
+	date := normalizeDate(e.Date)
+	if date == "" {
+		return false, nil
+	}
+
+	var covered bool
+	var err error
+	if e.Kind == KindOpening {
+		err = tx.QueryRow(`SELECT count(*) > 0 FROM history WHERE envelope = $1 AND date <= $2`,
+			e.EnvelopeId, date).Scan(&covered)
+	} else {
+		err = tx.QueryRow(`SELECT count(*) > 0 FROM history WHERE envelope = $1 AND kind = $2 AND date >= $3`,
+			e.EnvelopeId, KindOpening, date).Scan(&covered)
+	}
+	return covered, err
+}
+
+// handlePrune prunes the history from before the date given in before, see
+// PruneHistory.
+func handlePrune(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	before, err := time.Parse(time.DateOnly, r.FormValue("before"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf(`invalid date %q, want YYYY-MM-DD`, r.FormValue("before")))
+		return
+	}
+
+	if err := db.PruneHistory(before); err != nil {
+		log.Printf(`pruning failed: %s`, err)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("pruning failed"))
+		return
+	}
+
+	// Pruning must not change any envelope
+	writeIntegrity(db, w)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+)
+
+// statements holds the queries that run on every request or event, prepared
+// once when the DB is opened. Use tx.Stmt to run them inside a transaction.
+type statements struct {
+	allEnvelopes   *sql.Stmt
+	envelope       *sql.Stmt
+	insertEnvelope *sql.Stmt
+	insertEvent    *sql.Stmt
+	updateEnvelope *sql.Stmt
+}
+
+func (s *statements) prepare(db *sql.DB) error {
+	queries := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.allEnvelopes, `
+			SELECT e.id, e.name, e.balance, e.target, e.monthtarget, e.currency, e.goalamount, e.goaldate, e.liability,
+				e.excludetotals, e.owner, e.autospread, e.monthcap, h.balance, h.spent
+			FROM envelopes AS e LEFT OUTER JOIN
+				(SELECT h.envelope, sum(h.balance) AS balance,
+					-sum(CASE WHEN ` + isSpending + ` THEN h.balance ELSE 0 END) AS spent, h.date
+				 FROM history AS h
+				 WHERE datetime(h.date) >= datetime($1)
+				 GROUP BY h.envelope) AS h
+			ON e.id = h.envelope
+			WHERE not e.deleted AND e.archived = $2
+			ORDER BY e.sortorder, e.name`},
+		{&s.envelope, `
+			SELECT id, name, balance, target, monthtarget, currency, archived, goalamount, goaldate, liability, excludetotals,
+				owner, autospread, monthcap, metadate, metaevent
+			FROM envelopes
+			WHERE id = $1 AND not deleted`},
+		{&s.insertEnvelope, `
+			INSERT OR IGNORE INTO envelopes(id, name, balance, target, monthtarget, deleted, sortorder)
+			VALUES ($1, "", 0, 0, 0, 'false',
+				(SELECT CASE WHEN max(sortorder) > 0 THEN max(sortorder) + 1 ELSE 0 END FROM envelopes))`},
+		{&s.insertEvent, `
+			INSERT INTO history (id, envelope, name, balance, target, monthtarget, comment, deleted,
+				meta, prevtarget, prevmonthtarget, currency, reverses, origin, archived, tags,
+				goalamount, goaldate, date, kind, liability, excludetotals, owner, autospread, monthcap, attachment,
+				splitgroup, seq)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18,
+				$19, $20, $21, $22, $23, $24, $25, $26, $27, (SELECT coalesce(max(seq), 0) + 1 FROM history))`},
+		{&s.updateEnvelope, `
+			UPDATE envelopes
+			SET name = $1, balance = $2, target = $3, monthtarget = $4, deleted = $5,
+				currency = $6, archived = $7, goalamount = $8, goaldate = $9, liability = $10,
+				excludetotals = $11, owner = $12, autospread = $13, monthcap = $14, metadate = $15,
+				metaevent = $16
+			WHERE id = $17`},
+	}
+
+	for _, q := range queries {
+		stmt, err := db.Prepare(q.query)
+		if err != nil {
+			s.close()
+			return err
+		}
+		*q.stmt = stmt
+	}
+
+	return nil
+}
+
+func (s *statements) close() {
+	for _, stmt := range []*sql.Stmt{s.allEnvelopes, s.envelope, s.insertEnvelope, s.insertEvent, s.updateEnvelope} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// ExportEvents returns the whole history in the order it was recorded, so
+// that Restore can replay it. Changes that can still be undone are left out.
+func (d *DB) ExportEvents() ([]Event, error) {
+	events := []Event{}
+
+	rows, err := d.db.Query(`SELECT ` + eventColumns + ` FROM history WHERE pendinguntil = '' ORDER BY seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// Restore merges evts in order in a single transaction and returns how many
+// of them were new. Events that are already in the history are skipped, so
+// restoring the same export twice changes nothing. So are events from before
+// the history of their envelope was pruned, see PruneHistory.
+func (d *DB) Restore(evts []Event) (int, error) {
+	for _, e := range evts {
+		if e.Id == uuid.Nil || e.EnvelopeId == uuid.Nil {
+			return 0, fmt.Errorf(`%w: event without ID or envelope ID`, errInvalidValue)
+		}
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	restored := 0
+	for _, e := range evts {
+		var exists bool
+		err := tx.QueryRow(`SELECT count(*) > 0 FROM history WHERE id = $1`, e.Id).Scan(&exists)
+		if err != nil {
+			return 0, err
+		}
+		if exists {
+			continue
+		}
+		if covered, err := coveredWithTx(tx, e); err != nil {
+			return 0, err
+		} else if covered {
+			log.Printf(`skipping event %s from before the history of %s was pruned`, e.Id, e.EnvelopeId)
+			continue
+		}
+
+		if err := d.mergeEventWithTx(tx, e); err != nil {
+			return 0, err
+		}
+		restored++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return restored, d.persist()
+}
+
+func handleExport(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	events, err := db.ExportEvents()
+	if err != nil {
+		log.Printf(`export failed: %s`, err)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("export failed"))
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="envelopes-events.json"`)
+	writeJSON(w, http.StatusOK, events)
+}
+
+func handleRestore(db *DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	var events []Event
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&events); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	restored, err := db.Restore(events)
+	if errors.Is(err, errInvalidValue) {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		log.Printf(`restore failed: %s`, err)
+		writeJSONError(w, http.StatusInternalServerError, errors.New("restore failed"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Restored int `json:"restored"`
+		Skipped  int `json:"skipped"`
+	}{restored, len(events) - restored})
+}
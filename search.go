@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// SearchEvents returns the events of envelopes that aren't deleted whose
+// comment, name or envelope name contains term, ignoring case. The newest
+// events come first.
+func (d *DB) SearchEvents(term string) ([]Event, error) {
+	events := []Event{}
+
+	term = strings.TrimSpace(term)
+	if term == "" {
+		return events, nil
+	}
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(term)) + "%"
+
+	rows, err := d.db.Query(`
+		SELECT `+eventColumns+`
+		FROM history
+		WHERE envelope IN (SELECT id FROM envelopes WHERE NOT deleted)
+			AND (lower(comment) LIKE $1 ESCAPE '\'
+				OR lower(name) LIKE $1 ESCAPE '\'
+				OR envelope IN (SELECT id FROM envelopes WHERE lower(name) LIKE $1 ESCAPE '\'))
+		ORDER BY date DESC, seq DESC`, pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+func handleSearch(db *DB, w http.ResponseWriter, r *http.Request) {
+	q := r.FormValue("q")
+
+	events, err := db.SearchEvents(q)
+	if err != nil {
+		log.Printf(`search: can't search events: %s`, err)
+		redirect(w, r, "/")
+		return
+	}
+	events = visibleEvents(db, events, requestUser(r))
+
+	// Events carry the name the envelope had back then, show the current
+	// one as well
+	envelopes := map[uuid.UUID]*Envelope{}
+	for _, e := range append(db.AllEnvelopes(), db.ArchivedEnvelopes()...) {
+		envelopes[e.Id] = e
+	}
+
+	param := struct {
+		Query     string
+		Events    []Event
+		Envelopes map[uuid.UUID]*Envelope
+	}{q, events, envelopes}
+
+	if err := executeTemplate(w, "search.html", param); err != nil {
+		log.Printf(`error rendering search template: %s`, err)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// SplitLeg is the part of a split transaction that goes out of one envelope.
+type SplitLeg struct {
+	EnvelopeId uuid.UUID `json:"envelope_id"`
+	Amount     int       `json:"amount_cents"`
+}
+
+// splitRequest is a split transaction as submitted through the web form or
+// as JSON. Amounts are in minor units and always positive.
+type splitRequest struct {
+	Total   int        `json:"total_cents"`
+	Legs    []SplitLeg `json:"legs"`
+	Comment string     `json:"comment"`
+	Tags    []string   `json:"tags,omitempty"`
+}
+
+// SplitTx records money going out of several envelopes at once, like a
+// single purchase of things from different envelopes. The legs have to add
+// up to total and be in the same currency. They are recorded in a single
+// transaction with a shared SplitGroup, which is returned.
+func (d *DB) SplitTx(total int, legs []SplitLeg, comment string, tags ...string) (uuid.UUID, error) {
+	comment, err := cleanText("comment", comment, maxCommentLength)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if tags, err = cleanTags(tags); err != nil {
+		return uuid.Nil, err
+	}
+	if total <= 0 {
+		return uuid.Nil, fmt.Errorf(`%w: total must be positive`, errInvalidTx)
+	}
+	if len(legs) == 0 {
+		return uuid.Nil, fmt.Errorf(`%w: nothing to split into`, errInvalidTx)
+	}
+
+	group := uuid.New()
+	evts := []Event{}
+	seen := map[uuid.UUID]bool{}
+	currency, sum := "", 0
+	for _, leg := range legs {
+		if leg.Amount <= 0 {
+			return uuid.Nil, fmt.Errorf(`%w: amounts must be positive`, errInvalidTx)
+		}
+		if seen[leg.EnvelopeId] {
+			return uuid.Nil, fmt.Errorf(`%w: envelope %s is in the split twice`, errInvalidTx, leg.EnvelopeId)
+		}
+		seen[leg.EnvelopeId] = true
+
+		env, err := d.Envelope(leg.EnvelopeId)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if currency == "" {
+			currency = env.Currency
+		} else if env.Currency != currency {
+			return uuid.Nil, fmt.Errorf(`%w: can't split between %s and %s`, errInvalidTx, currency, env.Currency)
+		}
+
+		evt := d.balanceEvent(env, KindExternal, -leg.Amount, comment)
+		evt.Tags = tags
+		evt.SplitGroup = group
+		evts = append(evts, evt)
+		sum += leg.Amount
+	}
+	if sum != total {
+		cur := lookupCurrency(currency)
+		return uuid.Nil, fmt.Errorf(`%w: the parts add up to %s, not %s`, errInvalidTx, cur.Format(sum), cur.Format(total))
+	}
+
+	log.Printf(`dB split: %d into %d envelopes`, total, len(legs))
+	return group, d.mergeAll(evts)
+}
+
+// SplitEvents returns the legs of the split transaction with the given group.
+// Like with RecentEvents, their Name is the current name of the envelope.
+func (d *DB) SplitEvents(group uuid.UUID) ([]Event, error) {
+	events := []Event{}
+
+	rows, err := d.db.Query(`
+		SELECT `+eventColumns+`
+		FROM history
+		WHERE splitgroup = $1 AND NOT deleted
+		ORDER BY seq`, group)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError(err)
+	}
+
+	d.currentNames(events)
+	return events, nil
+}
+
+func isJSONBody(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+}
+
+// IsSplit returns whether e is a leg of a split transaction.
+func (e Event) IsSplit() bool {
+	return e.SplitGroup != uuid.Nil
+}
+
+// parseSplitRequest reads a split transaction from r, either as JSON or from
+// the fields of the web form. The form has a pair of envelope and amount
+// fields for each leg, empty pairs are skipped.
+func parseSplitRequest(db *DB, r *http.Request) (splitRequest, error) {
+	var req splitRequest
+	if isJSONBody(r) {
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			return req, fmt.Errorf(`%w: %w`, errInvalidTx, err)
+		}
+		return req, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return req, fmt.Errorf(`%w: %w`, errInvalidTx, err)
+	}
+	ids, amounts := r.Form["envelope"], r.Form["amount"]
+	if len(ids) != len(amounts) {
+		return req, fmt.Errorf(`%w: every part needs an envelope and an amount`, errInvalidTx)
+	}
+	currency := ""
+	for i := range ids {
+		if ids[i] == "" && strings.TrimSpace(amounts[i]) == "" {
+			continue
+		}
+		id, err := uuid.Parse(ids[i])
+		if err != nil {
+			return req, fmt.Errorf(`%w: invalid envelope %q`, errInvalidTx, ids[i])
+		}
+		env, err := db.Envelope(id)
+		if err != nil {
+			return req, err
+		}
+		if currency == "" {
+			currency = env.Currency
+		}
+		amount, err := lookupCurrency(env.Currency).Parse(amounts[i])
+		if err != nil {
+			return req, err
+		}
+		req.Legs = append(req.Legs, SplitLeg{id, amount})
+	}
+
+	total, err := lookupCurrency(currency).Parse(r.FormValue("total"))
+	if err != nil {
+		return req, err
+	}
+	req.Total = total
+	req.Comment = r.FormValue("comment")
+	req.Tags = parseTags(r.FormValue("tags"))
+	return req, nil
+}
+
+// handleSplit shows the form for a split transaction, starting with the
+// envelope given by id, and records the ones that are posted.
+func handleSplit(db *DB, w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+
+	if r.Method != "POST" {
+		params := struct {
+			Envelope  *Envelope
+			Envelopes []*Envelope
+			Parts     []int
+			Token     string
+		}{
+			Envelopes: visibleTo(db.AllEnvelopes(), user),
+			Parts:     []int{0, 1, 2, 3, 4},
+			Token:     uuid.NewString(),
+		}
+		if id, err := uuid.Parse(r.FormValue("id")); err == nil {
+			if env, err := db.Envelope(id); err == nil && env.VisibleTo(user) {
+				params.Envelope = env
+			}
+		}
+		if err := executeTemplate(w, "split.html", params); err != nil {
+			log.Printf(`error rendering split template: %s`, err)
+		}
+		return
+	}
+
+	req, err := parseSplitRequest(db, r)
+	if err != nil {
+		renderError(w, r, errorStatus(err), err)
+		return
+	}
+	for _, leg := range req.Legs {
+		env, err := db.Envelope(leg.EnvelopeId)
+		if errors.Is(err, errNotFound) || (err == nil && !env.VisibleTo(user)) {
+			renderError(w, r, http.StatusNotFound, errors.New("no such envelope"))
+			return
+		} else if err != nil {
+			log.Printf(`split: can't get envelope %s: %s`, leg.EnvelopeId, err)
+			renderError(w, r, http.StatusInternalServerError, errors.New("can't get envelope"))
+			return
+		}
+	}
+	if minTxAmount > 0 && req.Total < minTxAmount || maxTxAmount > 0 && req.Total > maxTxAmount {
+		renderError(w, r, http.StatusBadRequest, fmt.Errorf(`%w: total is outside the limits for transactions`, errInvalidTx))
+		return
+	}
+
+	// Only the web form has a token, see handleTx
+	token := r.FormValue("token")
+	if token != "" && !txTokens.claim(token) {
+		log.Printf(`split: form with token %s was already submitted, ignoring it`, token)
+		redirect(w, r, "/activity")
+		return
+	}
+
+	group, err := db.SplitTx(req.Total, req.Legs, req.Comment, req.Tags...)
+	if err != nil {
+		if token != "" {
+			txTokens.release(token)
+		}
+		status := errorStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Printf(`split: can't record split transaction: %s`, err)
+			err = errors.New("can't record split transaction")
+		}
+		renderError(w, r, status, err)
+		return
+	}
+
+	if wantsJSON(r) || isJSONBody(r) {
+		events, err := db.SplitEvents(group)
+		if err != nil {
+			log.Printf(`split: can't get split %s: %s`, group, err)
+			writeJSONError(w, http.StatusInternalServerError, errors.New("can't get split transaction"))
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			SplitGroup uuid.UUID `json:"split_group"`
+			Events     []Event   `json:"events"`
+		}{group, events})
+		return
+	}
+	redirect(w, r, "/activity?split="+group.String())
+}
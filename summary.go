@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EnvelopeMonthSummary is what happened to an envelope during one month.
+// Transfers and spreads between envelopes are counted separately from money
+// coming in from or going out to the outside world.
+type EnvelopeMonthSummary struct {
+	Id          uuid.UUID `json:"id"`
+	Name        string    `json:"name"`
+	Currency    string    `json:"currency"`
+	Start       int       `json:"start"`
+	In          int       `json:"in"`
+	Out         int       `json:"out"`
+	TransferIn  int       `json:"transfer_in"`
+	TransferOut int       `json:"transfer_out"`
+	End         int       `json:"end"`
+}
+
+// MonthlySummary returns the summary of all envelopes that aren't deleted and
+// existed during the given budget month, ordered by name. Out and TransferOut are
+// negative.
+func (d *DB) MonthlySummary(year, month int) ([]EnvelopeMonthSummary, error) {
+	first := budgetMonthStart(year, time.Month(month))
+	next := budgetMonthStart(year, time.Month(month)+1)
+
+	rows, err := d.db.Query(`
+		SELECT e.id, e.name, e.currency, date(h.date) >= $1, h.balance, h.kind
+		FROM history AS h JOIN envelopes AS e ON h.envelope = e.id
+		WHERE NOT e.deleted AND date(h.date) < $2
+		ORDER BY e.name, e.id`, first.Format("2006-01-02"), next.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rv := []EnvelopeMonthSummary{}
+	for rows.Next() {
+		var (
+			s       EnvelopeMonthSummary
+			inMonth bool
+			balance int
+			kind    string
+		)
+		if err := rows.Scan(&s.Id, &s.Name, &s.Currency, &inMonth, &balance, &kind); err != nil {
+			return nil, err
+		}
+		if len(rv) == 0 || rv[len(rv)-1].Id != s.Id {
+			s.Currency = lookupCurrency(s.Currency).Code
+			rv = append(rv, s)
+		}
+		cur := &rv[len(rv)-1]
+
+		cur.End += balance
+		switch {
+		case !inMonth || kind == KindOpening:
+			cur.Start += balance
+		case (kind == KindTransfer || kind == KindSpread) && balance < 0:
+			cur.TransferOut += balance
+		case kind == KindTransfer || kind == KindSpread:
+			cur.TransferIn += balance
+		case balance < 0:
+			cur.Out += balance
+		default:
+			cur.In += balance
+		}
+	}
+
+	return rv, rows.Err()
+}
+
+func handleSummary(db *DB, w http.ResponseWriter, r *http.Request) {
+	now := budgetMonthOf(time.Now())
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if r.FormValue("month") != "" {
+		m, err := time.Parse("2006-01", r.FormValue("month"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid month %q, expected YYYY-MM", r.FormValue("month")), http.StatusBadRequest)
+			return
+		}
+		month = m
+	}
+
+	summary, err := db.MonthlySummary(month.Year(), int(month.Month()))
+	if err != nil {
+		log.Printf(`summary: can't compute monthly summary: %s`, err)
+		http.Error(w, "can't compute monthly summary", http.StatusInternalServerError)
+		return
+	}
+	visible := visibleIds(db, requestUser(r))
+	shown := []EnvelopeMonthSummary{}
+	for _, e := range summary {
+		if visible[e.Id] {
+			shown = append(shown, e)
+		}
+	}
+	summary = shown
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, struct {
+			Month     string                 `json:"month"`
+			Envelopes []EnvelopeMonthSummary `json:"envelopes"`
+		}{month.Format("2006-01"), summary})
+		return
+	}
+
+	param := struct {
+		Month     string
+		Prev      string
+		Next      string
+		Envelopes []EnvelopeMonthSummary
+	}{
+		month.Format("2006-01"),
+		month.AddDate(0, -1, 0).Format("2006-01"),
+		month.AddDate(0, 1, 0).Format("2006-01"),
+		summary,
+	}
+
+	if err := executeTemplate(w, "summary.html", param); err != nil {
+		log.Printf(`error rendering summary template: %s`, err)
+	}
+}
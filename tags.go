@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+)
+
+// parseTags splits a comma separated list of tags. Tags are lower case, and
+// empty and duplicate tags are dropped.
+func parseTags(s string) []string {
+	rv := []string{}
+	seen := map[string]bool{}
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		rv = append(rv, t)
+	}
+	return rv
+}
+
+func (e Event) HasTag(tag string) bool {
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// EventsByTag returns all events of envelopes that aren't deleted which are
+// tagged with tag, oldest first.
+func (d *DB) EventsByTag(tag string) ([]Event, error) {
+	events := []Event{}
+
+	rows, err := d.db.Query(`
+		SELECT `+eventColumns+`
+		FROM history
+		WHERE instr(',' || tags || ',', ',' || $1 || ',') > 0
+			AND envelope IN (SELECT id FROM envelopes WHERE NOT deleted)
+		ORDER BY date, seq`, strings.ToLower(strings.TrimSpace(tag)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	templ *template.Template
+	// Directory the templates are loaded from
+	templateDir = "templates"
+	// If set, the templates are loaded again for every page, so changes
+	// show up without a restart
+	reloadTemplates = false
+)
+
+// loadTemplates parses all templates in dir. Errors name the file that
+// failed.
+func loadTemplates(dir string) (*template.Template, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf(`no templates found in %s`, dir)
+	}
+
+	t := template.New("").Funcs(templFuncs)
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := t.New(filepath.Base(f)).Parse(string(data)); err != nil {
+			return nil, fmt.Errorf(`can't parse template %s: %w`, f, err)
+		}
+	}
+
+	return t, nil
+}
+
+func executeTemplate(w io.Writer, name string, data interface{}) error {
+	t := templ
+	if reloadTemplates {
+		var err error
+		if t, err = loadTemplates(templateDir); err != nil {
+			return err
+		}
+	}
+	return t.ExecuteTemplate(w, name, data)
+}
+
+// wantsJSON tells whether the client asked for JSON instead of a page, either
+// with the Accept header or with format=json.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json") || r.FormValue("format") == "json"
+}
+
+// render sends data as JSON if the client asked for it, and otherwise renders
+// it with the template name.
+func render(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	w.Header().Add("Vary", "Accept")
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, data)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := executeTemplate(w, name, data); err != nil {
+		log.Printf(`error rendering template %s: %s`, name, err)
+	}
+}
+
+// renderError sends err as JSON or plain text, depending on what the client
+// asked for.
+func renderError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if wantsJSON(r) {
+		writeJSONError(w, status, err)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
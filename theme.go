@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const themeCookie = "theme"
+
+// Themes the pages can be shown in. Without one, the browser's preference
+// decides.
+var themes = map[string]bool{
+	"light": true,
+	"dark":  true,
+}
+
+// page carries what every rendered page needs besides its own data. It is
+// embedded in the data of the templates.
+type page struct {
+	Theme string `json:"-"`
+}
+
+// pageFor returns the page settings for r, taken from its cookies.
+func pageFor(r *http.Request) page {
+	p := page{}
+	if c, err := r.Cookie(themeCookie); err == nil && themes[c.Value] {
+		p.Theme = c.Value
+	}
+	return p
+}
+
+// handleTheme stores the theme given in the theme parameter in a cookie. An
+// unknown or empty theme clears it.
+func handleTheme(db *DB, w http.ResponseWriter, r *http.Request) {
+	returnTo := "/"
+	if r.FormValue("envelope") != "" {
+		returnTo = "/details?id=" + r.FormValue("envelope")
+	}
+
+	if r.Method != "POST" {
+		redirect(w, r, returnTo)
+		return
+	}
+
+	c := &http.Cookie{
+		Name:     themeCookie,
+		Value:    r.FormValue("theme"),
+		Path:     routePrefix + "/",
+		Expires:  time.Now().AddDate(1, 0, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if !themes[c.Value] {
+		c.Value = ""
+		c.Expires = time.Time{}
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+
+	redirect(w, r, returnTo)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// undoWindow is how long balance changes stay pending after they were made.
+// While they are, Undo removes them as if they never happened. They are only
+// emitted and exported once the window is over, so other instances never see
+// a change that is undone. 0 makes changes final right away.
+var undoWindow time.Duration
+
+// errNotPending is returned by Undo for changes that are already final.
+var errNotPending = errors.New("change can no longer be undone")
+
+// pendingChanges are the balance changes that can still be undone, by the IDs
+// of their events. Events that were recorded together are one change.
+type pendingChanges struct {
+	mu   sync.Mutex
+	byId map[uuid.UUID]*pendingChange
+}
+
+type pendingChange struct {
+	events []Event
+	until  time.Time
+	timer  *time.Timer
+}
+
+// pendingUntil returns until when evts can be undone, or the zero time if
+// they are final right away. Changes to metadata and deletions always are, as
+// is everything if there is no undo window.
+func pendingUntil(evts []Event) time.Time {
+	final := undoWindow <= 0 || len(evts) == 0
+	for _, evt := range evts {
+		final = final || evt.Meta || evt.Deleted
+	}
+	if final {
+		return time.Time{}
+	}
+	return time.Now().Add(undoWindow)
+}
+
+// markPendingWithTx records in the history that evts are pending until the
+// given time, so they stay pending across restarts. They are grouped by the
+// ID of the first one.
+func markPendingWithTx(tx *sql.Tx, evts []Event, until time.Time) error {
+	for _, evt := range evts {
+		_, err := tx.Exec(`UPDATE history SET pendinguntil = $1, pendinggroup = $2 WHERE id = $3`,
+			until.UTC().Format(dateFormat), evts[0].Id, evt.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hold keeps the committed events evts pending until the given time and
+// emits them once it is over. Final events, with a zero time, are emitted
+// immediately.
+func (d *DB) hold(evts []Event, until time.Time) {
+	if until.IsZero() {
+		for _, evt := range evts {
+			d.emit(evt)
+		}
+		return
+	}
+
+	d.pending.mu.Lock()
+	defer d.pending.mu.Unlock()
+
+	if d.pending.byId == nil {
+		d.pending.byId = map[uuid.UUID]*pendingChange{}
+	}
+	p := &pendingChange{events: evts, until: until}
+	for _, evt := range evts {
+		d.pending.byId[evt.Id] = p
+	}
+	p.timer = time.AfterFunc(time.Until(until), func() {
+		d.flush(p)
+	})
+}
+
+// loadPending holds the changes that were still pending when the DB was last
+// closed for the rest of their window. Those whose window is over become
+// final right away.
+func (d *DB) loadPending() error {
+	rows, err := d.db.Query(`
+		SELECT pendinggroup, max(pendinguntil) FROM history
+		WHERE pendinguntil != ''
+		GROUP BY pendinggroup`)
+	if err != nil {
+		return err
+	}
+	groups := map[uuid.UUID]time.Time{}
+	for rows.Next() {
+		var group uuid.UUID
+		var until string
+		if err := rows.Scan(&group, &until); err != nil {
+			rows.Close()
+			return err
+		}
+		t, err := time.Parse(dateFormat, until)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf(`invalid end of undo window %q: %w`, until, err)
+		}
+		groups[group] = t
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for group, until := range groups {
+		evts, err := d.pendingEvents(group)
+		if err != nil {
+			return err
+		}
+		d.hold(evts, until)
+	}
+	return nil
+}
+
+// pendingEvents returns the events of the pending change with the given group
+// in the order they were recorded.
+func (d *DB) pendingEvents(group uuid.UUID) ([]Event, error) {
+	rows, err := d.db.Query(`SELECT `+eventColumns+` FROM history WHERE pendinggroup = $1 ORDER BY seq`, group)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	evts := []Event{}
+	for rows.Next() {
+		evt, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		evts = append(evts, evt)
+	}
+	return evts, rows.Err()
+}
+
+// flush makes the pending change p final and emits its events, unless it was
+// undone in the meantime.
+func (d *DB) flush(p *pendingChange) {
+	d.pending.mu.Lock()
+	if d.pending.byId[p.events[0].Id] != p {
+		d.pending.mu.Unlock()
+		return
+	}
+	for _, evt := range p.events {
+		delete(d.pending.byId, evt.Id)
+	}
+	d.pending.mu.Unlock()
+
+	_, err := d.db.Exec(`UPDATE history SET pendinguntil = '', pendinggroup = '' WHERE pendinggroup = $1`, p.events[0].Id)
+	if err == nil {
+		err = d.persist()
+	}
+	if err != nil {
+		// It is made final again the next time the DB is opened
+		log.Printf(`can't make change %s final: %s`, p.events[0].Id, err)
+	}
+
+	for _, evt := range p.events {
+		d.emit(evt)
+	}
+}
+
+// Pending returns whether the event with the given ID can still be undone.
+func (d *DB) Pending(id uuid.UUID) bool {
+	d.pending.mu.Lock()
+	defer d.pending.mu.Unlock()
+
+	return d.pending.byId[id] != nil
+}
+
+// Undo removes the pending change the event with the given ID belongs to from
+// the history, along with the events that were recorded with it, as if it
+// never happened. Once a change is final, only ReverseEvent can compensate
+// it.
+func (d *DB) Undo(eventId uuid.UUID) error {
+	// Take the change out of the pending ones first, so it can't become
+	// final while it is undone
+	d.pending.mu.Lock()
+	p := d.pending.byId[eventId]
+	if p != nil {
+		p.timer.Stop()
+		for _, evt := range p.events {
+			delete(d.pending.byId, evt.Id)
+		}
+	}
+	d.pending.mu.Unlock()
+	if p == nil {
+		return errNotPending
+	}
+
+	if err := d.undoWithTx(p); err != nil {
+		// Keep it pending for the rest of its window
+		d.pending.mu.Lock()
+		for _, evt := range p.events {
+			d.pending.byId[evt.Id] = p
+		}
+		p.timer.Reset(time.Until(p.until))
+		d.pending.mu.Unlock()
+		return err
+	}
+	log.Printf(`undid %d events with %s`, len(p.events), eventId)
+
+	return dbError(d.persist())
+}
+
+// undoWithTx removes the events of p from the history and their balance
+// changes from the envelopes.
+func (d *DB) undoWithTx(p *pendingChange) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return dbError(err)
+	}
+	defer tx.Rollback()
+
+	for _, evt := range p.events {
+		var reversed bool
+		if err := tx.QueryRow(`SELECT count(*) > 0 FROM history WHERE reverses = $1`, evt.Id).Scan(&reversed); err != nil {
+			return dbError(err)
+		}
+		if reversed {
+			return fmt.Errorf(`%w: event %s has been reversed`, errNotPending, evt.Id)
+		}
+
+		if _, err := tx.Exec(`DELETE FROM history WHERE id = $1`, evt.Id); err != nil {
+			return dbError(err)
+		}
+		_, err = tx.Exec(`UPDATE envelopes SET balance = balance - $1 WHERE id = $2`, evt.Balance, evt.EnvelopeId)
+		if err != nil {
+			return dbError(err)
+		}
+	}
+
+	return dbError(tx.Commit())
+}
+
+// handleUndo undoes the pending change with the event given by id and returns
+// to the envelope given by envelope, like handleReverse.
+func handleUndo(db *DB, w http.ResponseWriter, r *http.Request) {
+	returnTo := "/"
+	if r.FormValue("envelope") != "" {
+		returnTo = "/details?id=" + r.FormValue("envelope")
+	}
+
+	if r.Method != "POST" {
+		redirect(w, r, returnTo)
+		return
+	}
+
+	id, err := uuid.Parse(r.FormValue("id"))
+	if err != nil {
+		log.Printf(`undo: can't parse ID: %s`, err)
+		redirect(w, r, returnTo)
+		return
+	}
+
+	if _, err := visibleEvent(db, id, requestUser(r)); errors.Is(err, errNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := db.Undo(id); err != nil {
+		log.Printf(`can't undo event %s: %s`, id, err)
+	}
+
+	redirect(w, r, returnTo)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxNameLength    = 100
+	maxCommentLength = 500
+	maxTagLength     = 50
+)
+
+// errInvalidValue is wrapped by errors about user supplied values the DB
+// refuses to store.
+var errInvalidValue = errors.New("invalid value")
+
+// cleanText strips control characters from s and makes sure it is at most max
+// characters long.
+func cleanText(what, s string, max int) (string, error) {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+	if utf8.RuneCountInString(s) > max {
+		return "", fmt.Errorf(`%w: %s is longer than %d characters`, errInvalidValue, what, max)
+	}
+	return s, nil
+}
+
+// cleanTags normalizes tags like parseTags and checks each of them with
+// cleanText.
+func cleanTags(tags []string) ([]string, error) {
+	tags = parseTags(strings.Join(tags, ","))
+	for i := range tags {
+		t, err := cleanText("tag", tags[i], maxTagLength)
+		if err != nil {
+			return nil, err
+		}
+		tags[i] = t
+	}
+	return tags, nil
+}